@@ -28,6 +28,8 @@ type Call struct {
 	Reply         interface{} // reply from the function
 	Error         error       // if error occurs, it will be set
 	Done          chan *Call  // Strobes when call is complete.
+
+	traceparent string // sent with the request, see Tracer
 }
 
 func (call *Call) done() {
@@ -41,6 +43,7 @@ func (call *Call) done() {
 type Client struct {
 	cc       codec.Codec
 	opt      *Option
+	target   string     // protocol@addr of the server, label of the metrics
 	sending  sync.Mutex // protect following
 	header   codec.Header
 	mu       sync.Mutex // protect following
@@ -121,6 +124,7 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Traceparent = call.traceparent
 
 	// encode and send the request
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -166,25 +170,43 @@ func (client *Client) receive() {
 // Go invokes the function asynchronously.
 // It returns the Call structure representing the invocation.
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	client.send(call)
+	return call
+}
+
+func newCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
-	client.send(call)
-	return call
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
-func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+// The call continues the trace carried by ctx, if any, see SpanContextFromContext.
+func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	start := time.Now()
+	parent, _ := SpanContextFromContext(ctx)
+	span := client.tracer().start(parent, serviceMethod, SpanKindClient)
+	if span != nil {
+		span.SetAttribute("net.peer.name", client.target)
+	}
+	defer func() {
+		client.metrics().record(client.target, serviceMethod, time.Since(start), err)
+		span.finish(err)
+	}()
+	// the server continues the trace of the client span
+	call := newCall(serviceMethod, args, reply, make(chan *Call, 1))
+	call.traceparent = span.propagate(parent).Traceparent()
+	client.send(call)
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
@@ -194,6 +216,13 @@ func (client *Client) Call(ctx context.Context, serviceMethod string, args, repl
 	}
 }
 
+func (client *Client) metrics() *ClientMetrics {
+	if client.opt.Metrics != nil {
+		return client.opt.Metrics
+	}
+	return DefaultClientMetrics
+}
+
 func parseOptions(opts ...*Option) (*Option, error) {
 	// if opts is nil or pass nil as parameter
 	if len(opts) == 0 || opts[0] == nil {
@@ -266,12 +295,18 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	}()
 	if opt.ConnectTimeout == 0 {
 		result := <-ch
+		if result.client != nil {
+			result.client.target = network + "@" + address
+		}
 		return result.client, result.err
 	}
 	select {
 	case <-time.After(opt.ConnectTimeout):
 		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
 	case result := <-ch:
+		if result.client != nil {
+			result.client.target = network + "@" + address
+		}
 		return result.client, result.err
 	}
 }
@@ -315,7 +350,11 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	protocol, addr := parts[0], parts[1]
 	switch protocol {
 	case "http":
-		return DialHTTP("tcp", addr, opts...)
+		client, err := DialHTTP("tcp", addr, opts...)
+		if err == nil {
+			client.target = rpcAddr
+		}
+		return client, err
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
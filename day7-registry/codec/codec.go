@@ -8,6 +8,7 @@ type Header struct {
 	ServiceMethod string // format "Service.Method"
 	Seq           uint64 // sequence number chosen by client
 	Error         string
+	Traceparent   string // W3C traceparent of the span sending the request, "" if not traced
 }
 
 type Codec interface {
@@ -0,0 +1,154 @@
+package geerpc
+
+import (
+	"fmt"
+	"geerpc/codec"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverConn is a connection served by the server, with the requests being
+// handled on it, see Server.Conns.
+type serverConn struct {
+	id          uint64
+	remoteAddr  string
+	connectedAt time.Time
+	closer      io.Closer
+	bytesIn     uint64 // accessed atomically
+	bytesOut    uint64 // accessed atomically
+	decoded     uint64 // bytes read by the codec, only accessed by serveCodec
+
+	mu       sync.Mutex // protect following
+	codec    codec.Type
+	requests map[*request]time.Time // start of the requests being handled
+}
+
+func (c *serverConn) setCodec(t codec.Type) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = t
+}
+
+// sent returns the bytes written on c, 0 if c is nil.
+func (c *serverConn) sent() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+// begin and end track req while it's handled, c may be nil.
+func (c *serverConn) begin(req *request) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[req] = time.Now()
+}
+
+func (c *serverConn) end(req *request) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.requests, req)
+}
+
+// ConnInfo is a connection served by the server.
+type ConnInfo struct {
+	ID          uint64        `json:"id"`
+	RemoteAddr  string        `json:"remote_addr"` // "" if the connection has no address, eg. a pipe
+	Codec       codec.Type    `json:"codec"`       // "" until the option is received
+	ConnectedAt time.Time     `json:"connected_at"`
+	BytesIn     uint64        `json:"bytes_in"`
+	BytesOut    uint64        `json:"bytes_out"`
+	Requests    []RequestInfo `json:"requests"` // being handled, oldest first
+}
+
+// RequestInfo is a request being handled, Elapsed is in nanoseconds in json.
+type RequestInfo struct {
+	ServiceMethod string        `json:"service_method"`
+	Seq           uint64        `json:"seq"`
+	Start         time.Time     `json:"start"`
+	Elapsed       time.Duration `json:"elapsed"`
+}
+
+func (c *serverConn) info(now time.Time) ConnInfo {
+	info := ConnInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.connectedAt,
+		BytesIn:     atomic.LoadUint64(&c.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.bytesOut),
+		Requests:    make([]RequestInfo, 0),
+	}
+	c.mu.Lock()
+	info.Codec = c.codec
+	for req, start := range c.requests {
+		info.Requests = append(info.Requests, RequestInfo{
+			ServiceMethod: req.h.ServiceMethod,
+			Seq:           req.h.Seq,
+			Start:         start,
+			Elapsed:       now.Sub(start),
+		})
+	}
+	c.mu.Unlock()
+	sort.Slice(info.Requests, func(i, j int) bool {
+		a, b := info.Requests[i], info.Requests[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		return a.Seq < b.Seq
+	})
+	return info
+}
+
+// Conns returns the connections open, sorted by ID, ie. by connect time.
+func (server *Server) Conns() []ConnInfo {
+	now := time.Now()
+	server.mu.Lock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for _, c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.mu.Unlock()
+	infos := make([]ConnInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info(now)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConn closes the connection id, see ConnInfo. The requests being handled
+// on it are not waited for, their replies are lost, and the connection is
+// listed by Conns until they return.
+func (server *Server) CloseConn(id uint64) error {
+	server.mu.Lock()
+	var closer io.Closer
+	for _, c := range server.conns {
+		if c.id == id {
+			closer = c.closer
+			break
+		}
+	}
+	server.mu.Unlock()
+	if closer == nil {
+		return fmt.Errorf("rpc server: no connection %d", id)
+	}
+	return closer.Close()
+}
+
+// remoteAddr returns the address of the peer of conn, if it's a net.Conn or alike.
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
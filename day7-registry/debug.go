@@ -5,28 +5,82 @@
 package geerpc
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
 )
 
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{with .Call}}
+	<hr>
+	Call {{.ServiceMethod}}({{.Arg}})
+	<hr>
+		{{if .Error}}<pre>error: {{.Error}}</pre>{{else}}<pre>{{.Reply}}</pre>{{end}}
+	{{end}}
+	{{range $svc := .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Successes</th><th align=center>Errors</th><th align=center>Timeouts</th><th align=center>In flight</th><th align=center>Mean latency</th><th align=center>Max latency</th><th align=center>Latency histogram</th>{{if $.AllowCalls}}<th align=center>Call with json argument</th>{{end}}
 		{{range $name, $mtype := .Method}}
+			{{with $mtype.Stats}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Successes}}</td>
+			<td align=center>{{range $code, $n := .Errors}}{{$code}}: {{$n}} {{else}}0{{end}}</td>
+			<td align=center>{{.Timeouts}}</td>
+			<td align=center>{{.InFlight}}</td>
+			<td align=center>{{.CallLatency.Mean}}</td>
+			<td align=center>{{$mtype.MaxLatency}}</td>
+			<td align=left font=fixed>{{.HandleLatency}}</td>
+			{{if $.AllowCalls}}<td><form method=post><input type=hidden name=call value="{{$svc.Name}}.{{$name}}"><textarea name=arg rows=1 cols=30></textarea><input type=submit value=Call></form></td>{{end}}
 			</tr>
+			{{end}}
 		{{end}}
 		</table>
 	{{end}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center>ID</th><th align=center>Remote address</th><th align=center>Codec</th><th align=center>Connected</th><th align=center>Bytes in</th><th align=center>Bytes out</th><th align=center>Requests</th>{{if $.AllowClose}}<th></th>{{end}}
+		{{range .Conns}}
+			<tr>
+			<td align=center>{{.ID}}</td>
+			<td align=left font=fixed>{{.RemoteAddr}}</td>
+			<td align=left>{{.Codec}}</td>
+			<td align=left>{{.ConnectedAt.Format "2006-01-02 15:04:05"}}</td>
+			<td align=center>{{.BytesIn}}</td>
+			<td align=center>{{.BytesOut}}</td>
+			<td align=center>{{len .Requests}}</td>
+			{{if $.AllowClose}}<td><form method=post><input type=hidden name=close value={{.ID}}><input type=submit value=Close></form></td>{{end}}
+			</tr>
+		{{end}}
+		</table>
+	<hr>
+	In-flight requests
+	<hr>
+		<table>
+		<th align=center>Connection</th><th align=center>Method</th><th align=center>Seq</th><th align=center>Elapsed</th>
+		{{range $conn := .Conns}}
+			{{range .Requests}}
+			<tr>
+			<td align=center>{{$conn.ID}}</td>
+			<td align=left font=fixed>{{.ServiceMethod}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=center>{{.Elapsed}}</td>
+			</tr>
+			{{end}}
+		{{end}}
+		</table>
 	</body>
 	</html>`
 
@@ -36,13 +90,78 @@ type debugHTTP struct {
 	*Server
 }
 
+type debugPage struct {
+	Services   []debugService
+	Conns      []ConnInfo
+	AllowCalls bool
+	AllowClose bool
+	Call       *debugCall // result of the call posted, if any
+}
+
 type debugService struct {
 	Name   string
 	Method map[string]*methodType
 }
 
-// Runs at /debug/geerpc
+// DebugService is a service in the json debug page, see DebugMethod.
+type DebugService struct {
+	Name    string        `json:"name"`
+	Methods []DebugMethod `json:"methods"`
+}
+
+// DebugMethod is a method in the json debug page, latencies are in milliseconds,
+// the histograms are in nanoseconds, see MethodStats.
+type DebugMethod struct {
+	Name          string            `json:"name"`
+	ArgType       string            `json:"arg_type"`
+	ReplyType     string            `json:"reply_type"`
+	Calls         uint64            `json:"calls"`
+	Successes     uint64            `json:"successes"`
+	Errors        uint64            `json:"errors"`
+	ErrorCodes    map[string]uint64 `json:"error_codes"`
+	Timeouts      uint64            `json:"timeouts"`
+	InFlight      int64             `json:"in_flight"`
+	MeanLatencyMs float64           `json:"mean_latency_ms"`
+	MaxLatencyMs  float64           `json:"max_latency_ms"`
+	CallLatency   Histogram         `json:"call_latency"`
+	HandleLatency Histogram         `json:"handle_latency"`
+}
+
+// Runs at /debug/geerpc, add ?format=json for the machine readable version:
+//
+//	{"services": [{"name": "Foo", "methods": [{"name": "Sum", "arg_type": "main.Args", ...}]}],
+//	 "connections": [{"id": 1, "remote_addr": "127.0.0.1:50428", "requests": [...], ...}]}
+//
+// If closing connections is allowed, see DebugOption, POST close=<id> closes
+// the connection id. If calls are allowed,
+// POST call=<service method>&arg=<json> calls the method and shows the reply,
+// as {"reply": ..., "error": "..."} with ?format=json.
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var call *debugCall
+	if req.Method == http.MethodPost {
+		if req.FormValue("call") == "" {
+			server.closeConn(w, req)
+			return
+		}
+		call = &debugCall{ServiceMethod: req.FormValue("call"), Arg: req.FormValue("arg")}
+		reply, err := server.debugInvoke(call.ServiceMethod, call.Arg)
+		if err == errDebugCallsDisabled {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		call.Reply = reply
+		if err != nil {
+			call.Error = err.Error()
+		}
+		if req.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(struct {
+				Reply json.RawMessage `json:"reply,omitempty"`
+				Error string          `json:"error,omitempty"`
+			}{json.RawMessage(call.Reply), call.Error})
+			return
+		}
+	}
 	// Build a sorted version of the data.
 	var services []debugService
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
@@ -53,8 +172,72 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Services    []DebugService `json:"services"`
+			Connections []ConnInfo     `json:"connections"`
+		}{debugJSON(services), server.Conns()})
+		return
+	}
+	opt := server.debugOption()
+	page := debugPage{
+		Services:   services,
+		Conns:      server.Conns(),
+		AllowCalls: opt.AllowCalls,
+		AllowClose: opt.AllowClose,
+		Call:       call,
+	}
+	err := debug.Execute(w, page)
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
 }
+
+func debugJSON(services []debugService) []DebugService {
+	out := make([]DebugService, 0, len(services))
+	for _, svc := range services {
+		s := DebugService{Name: svc.Name, Methods: make([]DebugMethod, 0, len(svc.Method))}
+		for name, m := range svc.Method {
+			stats := m.Stats()
+			s.Methods = append(s.Methods, DebugMethod{
+				Name:          name,
+				ArgType:       m.ArgType.String(),
+				ReplyType:     m.ReplyType.String(),
+				Calls:         stats.Calls,
+				Successes:     stats.Successes,
+				Errors:        m.NumErrors(),
+				ErrorCodes:    stats.Errors,
+				Timeouts:      stats.Timeouts,
+				InFlight:      stats.InFlight,
+				MeanLatencyMs: stats.CallLatency.Mean().Seconds() * 1000,
+				MaxLatencyMs:  m.MaxLatency().Seconds() * 1000,
+				CallLatency:   stats.CallLatency,
+				HandleLatency: stats.HandleLatency,
+			})
+		}
+		sort.Slice(s.Methods, func(i, j int) bool { return s.Methods[i].Name < s.Methods[j].Name })
+		out = append(out, s)
+	}
+	return out
+}
+
+// closeConn closes the connection of the close form value, and goes back to the page.
+func (server debugHTTP) closeConn(w http.ResponseWriter, req *http.Request) {
+	if !server.debugOption().AllowClose {
+		http.Error(w, errDebugCloseDisabled.Error(), http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseUint(req.FormValue("close"), 10, 64)
+	if err != nil {
+		http.Error(w, "rpc server: invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if err := server.CloseConn(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println("rpc server: closed connection", id, "from the debug page")
+	http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+}
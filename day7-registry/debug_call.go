@@ -0,0 +1,135 @@
+package geerpc
+
+import (
+	"encoding/json"
+	"errors"
+	"geerpc/codec"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugOption configures the debug page of a server, see Server.SetDebugOption.
+type DebugOption struct {
+	// AllowCalls shows a form calling the methods with a json argument.
+	// Anyone reaching the debug page can then call any method, so only
+	// enable it where the page is restricted to administrators.
+	AllowCalls  bool
+	CallTimeout time.Duration // handle timeout of the calls, 0 means no limit
+	// AllowClose shows a button closing each connection, restrict the page
+	// to administrators as well.
+	AllowClose bool
+}
+
+// DefaultDebugOption doesn't allow calls nor closing connections.
+var DefaultDebugOption = &DebugOption{}
+
+// SetDebugOption sets the option of the debug page, nil means DefaultDebugOption.
+func (server *Server) SetDebugOption(opt *DebugOption) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.debugOpt = opt
+}
+
+func (server *Server) debugOption() DebugOption {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.debugOpt == nil {
+		return *DefaultDebugOption
+	}
+	return *server.debugOpt
+}
+
+var (
+	errDebugCallsDisabled = errors.New("rpc server: calls from the debug page are disabled")
+	errDebugCloseDisabled = errors.New("rpc server: closing connections from the debug page is disabled")
+)
+
+// debugCall is a call from the debug page, and its result.
+type debugCall struct {
+	ServiceMethod string
+	Arg           string
+	Reply         string // json
+	Error         string
+}
+
+// debugCodec is the codec of a call from the debug page: there is nothing to
+// read, and only the first response is kept, the one of a timeout if any.
+type debugCodec struct {
+	mu    sync.Mutex
+	sent  bool
+	reply []byte
+	err   string
+}
+
+var _ codec.Codec = (*debugCodec)(nil)
+
+var errNothingToRead = errors.New("rpc server: nothing to read")
+
+func (c *debugCodec) ReadHeader(*codec.Header) error { return errNothingToRead }
+func (c *debugCodec) ReadBody(interface{}) error     { return errNothingToRead }
+func (c *debugCodec) Close() error                   { return nil }
+
+func (c *debugCodec) Write(h *codec.Header, body interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent {
+		return nil
+	}
+	c.sent = true
+	if h.Error != "" {
+		c.err = h.Error
+		return nil
+	}
+	reply, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		c.err = "rpc server: encode reply error: " + err.Error()
+		return err
+	}
+	c.reply = reply
+	return nil
+}
+
+// debugInvoke calls serviceMethod with arg, a json value of its ArgType, and
+// returns its reply as json. The request goes through handleRequest like the
+// requests of connections, so it's counted, traced and timed out the same way.
+func (server *Server) debugInvoke(serviceMethod, arg string) (string, error) {
+	opt := server.debugOption()
+	if !opt.AllowCalls {
+		return "", errDebugCallsDisabled
+	}
+	if server.shuttingDown() {
+		return "", ErrServerShutdown
+	}
+	req := &request{h: &codec.Header{ServiceMethod: serviceMethod}}
+	var err error
+	req.svc, req.mtype, err = server.findService(serviceMethod)
+	if err != nil {
+		return "", err
+	}
+	req.argv = req.mtype.newArgv()
+	req.replyv = req.mtype.newReplyv()
+	argvi := req.argv.Interface()
+	if req.argv.Kind() != reflect.Ptr {
+		argvi = req.argv.Addr().Interface()
+	}
+	if strings.TrimSpace(arg) != "" {
+		if err := json.Unmarshal([]byte(arg), argvi); err != nil {
+			return "", errors.New("rpc server: invalid argument of type " + req.mtype.ArgType.String() + ": " + err.Error())
+		}
+	}
+
+	cc := new(debugCodec)
+	wg := new(sync.WaitGroup)
+	atomic.AddInt64(&server.inflight, 1)
+	wg.Add(1)
+	server.handleRequest(server.context(), cc, req, new(sync.Mutex), wg, opt.CallTimeout)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.err != "" {
+		return "", errors.New(cc.err)
+	}
+	return string(cc.reply), nil
+}
@@ -0,0 +1,56 @@
+package geerpc
+
+import "sync"
+
+// Serving status reported by Health.Check
+const (
+	Serving        = "SERVING"
+	NotServing     = "NOT_SERVING"
+	ServiceUnknown = "SERVICE_UNKNOWN"
+)
+
+// HealthCheckArgs names the service to check, empty means the whole server.
+type HealthCheckArgs struct {
+	Service string
+}
+
+type HealthCheckReply struct {
+	Status string
+}
+
+// Health is the standard health checking service, register it
+// to let clients probe the server:
+//
+//	_ = server.Register(geerpc.NewHealth())
+type Health struct {
+	mu     sync.RWMutex
+	status map[string]string // service name -> serving status
+}
+
+// NewHealth returns a Health reporting the whole server as serving.
+func NewHealth() *Health {
+	return &Health{status: map[string]string{"": Serving}}
+}
+
+// SetServingStatus sets the status of service, empty service means the whole server.
+func (h *Health) SetServingStatus(service string, serving bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if serving {
+		h.status[service] = Serving
+	} else {
+		h.status[service] = NotServing
+	}
+}
+
+// Check reports the serving status of args.Service.
+func (h *Health) Check(args HealthCheckArgs, reply *HealthCheckReply) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status, ok := h.status[args.Service]
+	if !ok {
+		status = ServiceUnknown
+	}
+	reply.Status = status
+	return nil
+}
@@ -39,7 +39,8 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	l, _ := net.Listen("tcp", ":0")
 	server := geerpc.NewServer()
 	_ = server.Register(&foo)
-	registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0)
+	hb := registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0, server.ServiceMethods()...)
+	server.RegisterOnShutdown(func() { _ = hb.Stop() })
 	wg.Done()
 	server.Accept(l)
 }
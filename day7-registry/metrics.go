@@ -0,0 +1,320 @@
+package geerpc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics are served in the Prometheus text exposition format, version 0.0.4:
+//
+//	# HELP geerpc_server_requests_total Requests handled.
+//	# TYPE geerpc_server_requests_total counter
+//	geerpc_server_requests_total{service="Foo",method="Sum"} 42
+//
+// Durations are in seconds, histograms have the buckets of Histogram.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsWriter writes metrics in the text format, the first error is kept.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, v ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, v...)
+	}
+}
+
+// header writes the help and the type of the metric name.
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of name, labels are pairs of label name and value.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+// histogram writes h as the cumulative buckets, the sum and the count of name.
+func (mw *metricsWriter) histogram(name string, h Histogram, labels ...string) {
+	var cumulative uint64
+	for i, n := range h.Counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i].Seconds())
+		}
+		mw.sample(name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", le)...)
+	}
+	mw.sample(name+"_sum", h.Sum.Seconds(), labels...)
+	mw.sample(name+"_count", float64(h.Count), labels...)
+}
+
+func (mw *metricsWriter) flush() error {
+	if mw.err == nil {
+		mw.err = mw.w.Flush()
+	}
+	return mw.err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingConn counts the bytes read and written on conn.
+type countingConn struct {
+	io.ReadWriteCloser
+	conn *serverConn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddUint64(&c.conn.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddUint64(&c.conn.bytesOut, uint64(n))
+	return n, err
+}
+
+// WriteMetrics writes the metrics of the server, labelled by service and method:
+// requests, errors by code, timeouts as the "timeout" code, the duration
+// of the requests, the calls running and the bytes of the requests and
+// replies. Connections are the ones of the whole server.
+func (server *Server) WriteMetrics(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	stats := server.Stats()
+	mw.header("geerpc_server_requests_total", "counter", "Requests handled.")
+	for _, s := range stats {
+		var errs uint64
+		for _, n := range s.Errors {
+			errs += n
+		}
+		mw.sample("geerpc_server_requests_total", float64(s.Successes+errs+s.Timeouts), "service", s.Service, "method", s.Method)
+	}
+	mw.header("geerpc_server_errors_total", "counter", "Requests replied with an error, by code.")
+	for _, s := range stats {
+		codes := make([]string, 0, len(s.Errors))
+		for code := range s.Errors {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			mw.sample("geerpc_server_errors_total", float64(s.Errors[code]), "service", s.Service, "method", s.Method, "code", code)
+		}
+		if s.Timeouts > 0 {
+			mw.sample("geerpc_server_errors_total", float64(s.Timeouts), "service", s.Service, "method", s.Method, "code", "timeout")
+		}
+	}
+	mw.header("geerpc_server_request_duration_seconds", "histogram", "Duration of the requests, from the call to the reply sent.")
+	for _, s := range stats {
+		mw.histogram("geerpc_server_request_duration_seconds", s.HandleLatency, "service", s.Service, "method", s.Method)
+	}
+	mw.header("geerpc_server_in_flight", "gauge", "Calls running.")
+	for _, s := range stats {
+		mw.sample("geerpc_server_in_flight", float64(s.InFlight), "service", s.Service, "method", s.Method)
+	}
+	mw.header("geerpc_server_received_bytes_total", "counter", "Bytes of the requests received.")
+	for _, s := range stats {
+		mw.sample("geerpc_server_received_bytes_total", float64(s.BytesIn), "service", s.Service, "method", s.Method)
+	}
+	mw.header("geerpc_server_sent_bytes_total", "counter", "Bytes of the replies sent.")
+	for _, s := range stats {
+		mw.sample("geerpc_server_sent_bytes_total", float64(s.BytesOut), "service", s.Service, "method", s.Method)
+	}
+	server.mu.Lock()
+	conns := len(server.conns)
+	server.mu.Unlock()
+	mw.header("geerpc_server_connections", "gauge", "Open connections.")
+	mw.sample("geerpc_server_connections", float64(conns))
+	return mw.flush()
+}
+
+type metricsHTTP struct {
+	*Server
+}
+
+// Runs at the path given to HandleMetrics
+func (server metricsHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := server.WriteMetrics(w); err != nil {
+		log.Println("rpc server: write metrics error:", err)
+		return
+	}
+	if err := DefaultClientMetrics.WriteMetrics(w); err != nil {
+		log.Println("rpc server: write metrics error:", err)
+	}
+}
+
+// HandleMetrics registers an HTTP handler serving the metrics of the server
+// on path, followed by the ones of the clients using DefaultClientMetrics,
+// so that a single path is scraped for both.
+func (server *Server) HandleMetrics(path string) {
+	http.Handle(path, metricsHTTP{server})
+	log.Println("rpc server metrics path:", path)
+}
+
+// ClientMetrics collects the metrics of the calls of clients, labelled by
+// target, the protocol@addr of the server, service and method.
+// Clients use DefaultClientMetrics unless Option.Metrics is set.
+type ClientMetrics struct {
+	mu     sync.Mutex // protect following
+	calls  map[clientCallKey]*clientCallStats
+	fanout map[clientCallKey]uint64 // target is empty
+}
+
+type clientCallKey struct {
+	target, service, method string
+}
+
+type clientCallStats struct {
+	requests uint64
+	errors   uint64
+	latency  histogram
+}
+
+// DefaultClientMetrics is the ClientMetrics of the clients without Option.Metrics.
+var DefaultClientMetrics = NewClientMetrics()
+
+func NewClientMetrics() *ClientMetrics {
+	return &ClientMetrics{
+		calls:  make(map[clientCallKey]*clientCallStats),
+		fanout: make(map[clientCallKey]uint64),
+	}
+}
+
+func splitServiceMethod(serviceMethod string) (service, method string) {
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		return serviceMethod[:dot], serviceMethod[dot+1:]
+	}
+	return serviceMethod, ""
+}
+
+// record records a call of serviceMethod to target which took d.
+func (m *ClientMetrics) record(target, serviceMethod string, d time.Duration, err error) {
+	service, method := splitServiceMethod(serviceMethod)
+	key := clientCallKey{target: target, service: service, method: method}
+	m.mu.Lock()
+	s := m.calls[key]
+	if s == nil {
+		s = new(clientCallStats)
+		m.calls[key] = s
+	}
+	s.requests++
+	if err != nil {
+		s.errors++
+	}
+	m.mu.Unlock()
+	s.latency.observe(d)
+}
+
+// RecordFanout records n additional requests sent in parallel for a call of
+// serviceMethod, eg. the other servers a call is forked to, see xclient.XClient.
+func (m *ClientMetrics) RecordFanout(serviceMethod string, n int) {
+	if n <= 0 {
+		return
+	}
+	service, method := splitServiceMethod(serviceMethod)
+	m.mu.Lock()
+	m.fanout[clientCallKey{service: service, method: method}] += uint64(n)
+	m.mu.Unlock()
+}
+
+// WriteMetrics writes the metrics of the calls: requests, errors, the duration
+// of the requests by target, and the fan-out.
+func (m *ClientMetrics) WriteMetrics(w io.Writer) error {
+	type call struct {
+		clientCallKey
+		requests, errors uint64
+		latency          Histogram
+	}
+	m.mu.Lock()
+	calls := make([]call, 0, len(m.calls))
+	for key, s := range m.calls {
+		calls = append(calls, call{clientCallKey: key, requests: s.requests, errors: s.errors, latency: s.latency.snapshot()})
+	}
+	fanout, fanoutCounts := copyCounts(m.fanout)
+	m.mu.Unlock()
+	less := func(a, b clientCallKey) bool {
+		if a.target != b.target {
+			return a.target < b.target
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.method < b.method
+	}
+	sort.Slice(calls, func(i, j int) bool { return less(calls[i].clientCallKey, calls[j].clientCallKey) })
+	sort.Slice(fanout, func(i, j int) bool { return less(fanout[i], fanout[j]) })
+
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	mw.header("geerpc_client_requests_total", "counter", "Calls sent, by target.")
+	for _, c := range calls {
+		mw.sample("geerpc_client_requests_total", float64(c.requests), "target", c.target, "service", c.service, "method", c.method)
+	}
+	mw.header("geerpc_client_errors_total", "counter", "Calls failed, by target.")
+	for _, c := range calls {
+		mw.sample("geerpc_client_errors_total", float64(c.errors), "target", c.target, "service", c.service, "method", c.method)
+	}
+	mw.header("geerpc_client_request_duration_seconds", "histogram", "Duration of the calls, by target.")
+	for _, c := range calls {
+		mw.histogram("geerpc_client_request_duration_seconds", c.latency, "target", c.target, "service", c.service, "method", c.method)
+	}
+	mw.header("geerpc_client_fanout_requests_total", "counter", "Additional requests sent in parallel for calls.")
+	for _, key := range fanout {
+		mw.sample("geerpc_client_fanout_requests_total", float64(fanoutCounts[key]), "service", key.service, "method", key.method)
+	}
+	return mw.flush()
+}
+
+// copyCounts returns the keys and a copy of counts.
+func copyCounts(counts map[clientCallKey]uint64) ([]clientCallKey, map[clientCallKey]uint64) {
+	keys := make([]clientCallKey, 0, len(counts))
+	c := make(map[clientCallKey]uint64, len(counts))
+	for key, n := range counts {
+		keys = append(keys, key)
+		c[key] = n
+	}
+	return keys, c
+}
+
+// ServeHTTP serves the metrics of m, for clients without a Server.HandleMetrics.
+func (m *ClientMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := m.WriteMetrics(w); err != nil {
+		log.Println("rpc client: write metrics error:", err)
+	}
+}
@@ -0,0 +1,161 @@
+package geerpc
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// ReflectionService is the name of the service describing the services of
+// a server, see RegisterReflection. Clients call it like any other service:
+//
+//	var services []ServiceDescription
+//	err := client.Call(ctx, "_Reflection.ListServices", ListServicesArgs{}, &services)
+//	var method MethodDescription
+//	err = client.Call(ctx, "_Reflection.DescribeMethod", DescribeMethodArgs{"Foo.Sum"}, &method)
+const ReflectionService = "_Reflection"
+
+// ListServicesArgs filters the services listed, "" means all of them.
+type ListServicesArgs struct {
+	Service string
+}
+
+// ServiceDescription is a service and the names of its methods, sorted.
+type ServiceDescription struct {
+	Name    string   `json:"name"`
+	Methods []string `json:"methods"`
+}
+
+type DescribeMethodArgs struct {
+	ServiceMethod string // format "Service.Method"
+}
+
+// MethodDescription describes the argument and the reply of a method.
+type MethodDescription struct {
+	ServiceMethod string           `json:"service_method"`
+	ArgType       *TypeDescription `json:"arg_type"`
+	ReplyType     *TypeDescription `json:"reply_type"`
+}
+
+// TypeDescription is the structure of a type, enough to build values of it
+// without its Go definition, eg. as json.
+type TypeDescription struct {
+	Name   string             `json:"name,omitempty"`   // eg. "main.Args", "" for unnamed types
+	Kind   string             `json:"kind"`             // reflect.Kind, eg. "struct", "int", "slice"
+	Elem   *TypeDescription   `json:"elem,omitempty"`   // element of pointers, slices, arrays, maps and chans
+	Key    *TypeDescription   `json:"key,omitempty"`    // key of maps
+	Len    int                `json:"len,omitempty"`    // length of arrays
+	Fields []FieldDescription `json:"fields,omitempty"` // exported fields of structs
+	// Ref is set for a named type described by one of its enclosing types,
+	// eg. a linked list node, only Name and Kind are set then.
+	Ref bool `json:"ref,omitempty"`
+}
+
+type FieldDescription struct {
+	Name     string           `json:"name"`
+	Type     *TypeDescription `json:"type"`
+	Embedded bool             `json:"embedded,omitempty"`
+}
+
+// DescribeType returns the structure of t.
+func DescribeType(t reflect.Type) *TypeDescription {
+	return describeType(t, make(map[reflect.Type]bool))
+}
+
+// describeType describes t, enclosing holds the named types being described.
+func describeType(t reflect.Type, enclosing map[reflect.Type]bool) *TypeDescription {
+	d := &TypeDescription{Kind: t.Kind().String()}
+	if t.Name() != "" {
+		d.Name = t.String()
+		if enclosing[t] {
+			d.Ref = true
+			return d
+		}
+		enclosing[t] = true
+		defer delete(enclosing, t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Chan:
+		d.Elem = describeType(t.Elem(), enclosing)
+	case reflect.Array:
+		d.Elem = describeType(t.Elem(), enclosing)
+		d.Len = t.Len()
+	case reflect.Map:
+		d.Key = describeType(t.Key(), enclosing)
+		d.Elem = describeType(t.Elem(), enclosing)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported, not encoded
+			}
+			d.Fields = append(d.Fields, FieldDescription{
+				Name:     f.Name,
+				Type:     describeType(f.Type, enclosing),
+				Embedded: f.Anonymous,
+			})
+		}
+	}
+	return d
+}
+
+// reflectionService is the receiver of ReflectionService.
+type reflectionService struct {
+	server *Server
+}
+
+func (r *reflectionService) ListServices(args ListServicesArgs, reply *[]ServiceDescription) error {
+	services := make([]ServiceDescription, 0)
+	r.server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		if args.Service != "" && args.Service != svc.name {
+			return true
+		}
+		methods := make([]string, 0, len(svc.method))
+		for name := range svc.method {
+			methods = append(methods, name)
+		}
+		sort.Strings(methods)
+		services = append(services, ServiceDescription{Name: svc.name, Methods: methods})
+		return true
+	})
+	if args.Service != "" && len(services) == 0 {
+		return errors.New("rpc server: can't find service " + args.Service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	*reply = services
+	return nil
+}
+
+func (r *reflectionService) DescribeMethod(args DescribeMethodArgs, reply *MethodDescription) error {
+	_, mtype, err := r.server.findService(args.ServiceMethod)
+	if err != nil {
+		return err
+	}
+	*reply = MethodDescription{
+		ServiceMethod: args.ServiceMethod,
+		ArgType:       DescribeType(mtype.ArgType),
+		ReplyType:     DescribeType(mtype.ReplyType),
+	}
+	return nil
+}
+
+// RegisterReflection publishes ReflectionService in the server, so that
+// clients can list the services and describe the types of their methods.
+func (server *Server) RegisterReflection() error {
+	rcvr := &reflectionService{server: server}
+	// newService only accepts exported names
+	s := &service{
+		name: ReflectionService,
+		typ:  reflect.TypeOf(rcvr),
+		rcvr: reflect.ValueOf(rcvr),
+	}
+	s.registerMethods()
+	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
+		return errors.New("rpc: service already defined: " + s.name)
+	}
+	return nil
+}
+
+// RegisterReflection publishes ReflectionService in the DefaultServer.
+func RegisterReflection() error { return DefaultServer.RegisterReflection() }
@@ -0,0 +1,70 @@
+package geerpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type node struct {
+	Value    int
+	Next     *node
+	Children map[string][]node
+	Tags     [2]string
+	hidden   bool
+}
+
+func TestDescribeType(t *testing.T) {
+	d := DescribeType(reflect.TypeOf(node{}))
+	_assert(d.Name == "geerpc.node" && d.Kind == "struct" && len(d.Fields) == 4, "wrong description %+v", d)
+	value, next, children, tags := d.Fields[0], d.Fields[1], d.Fields[2], d.Fields[3]
+	_assert(value.Name == "Value" && value.Type.Kind == "int" && value.Type.Name == "int", "wrong field %+v", value)
+	_assert(next.Type.Kind == "ptr" && next.Type.Name == "" && next.Type.Elem.Ref && next.Type.Elem.Name == "geerpc.node",
+		"expect a reference to the enclosing type, got %+v", next.Type.Elem)
+	_assert(children.Type.Kind == "map" && children.Type.Key.Kind == "string" && children.Type.Elem.Kind == "slice" &&
+		children.Type.Elem.Elem.Ref, "wrong map field %+v", children.Type)
+	_assert(tags.Type.Kind == "array" && tags.Type.Len == 2 && tags.Type.Elem.Kind == "string", "wrong array field %+v", tags.Type)
+
+	// the same type in sibling fields is described twice, only enclosing types are references
+	type pair struct{ A, B Args }
+	d = DescribeType(reflect.TypeOf(pair{}))
+	_assert(!d.Fields[0].Type.Ref && !d.Fields[1].Type.Ref && len(d.Fields[1].Type.Fields) == 2, "wrong description %+v", d)
+}
+
+func TestServer_RegisterReflection(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	var s Slow
+	_ = server.Register(&foo)
+	_ = server.Register(&s)
+	_assert(server.RegisterReflection() == nil, "failed to register reflection")
+	_assert(server.RegisterReflection() != nil, "expect reflection to be registered once")
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var services []ServiceDescription
+	err = client.Call(context.Background(), ReflectionService+".ListServices", ListServicesArgs{}, &services)
+	_assert(err == nil && len(services) == 3, "expect 3 services, got %+v: %v", services, err)
+	_assert(services[0].Name == "Foo" && services[1].Name == "Slow" && services[2].Name == ReflectionService,
+		"expect sorted services, got %+v", services)
+	_assert(reflect.DeepEqual(services[1].Methods, []string{"Fail", "Sleep"}), "expect sorted methods, got %v", services[1].Methods)
+	err = client.Call(context.Background(), ReflectionService+".ListServices", ListServicesArgs{Service: "Slow"}, &services)
+	_assert(err == nil && len(services) == 1 && services[0].Name == "Slow", "expect Slow only, got %+v: %v", services, err)
+	err = client.Call(context.Background(), ReflectionService+".ListServices", ListServicesArgs{Service: "Bar"}, &services)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect an unknown service, got %v", err)
+
+	var method MethodDescription
+	err = client.Call(context.Background(), ReflectionService+".DescribeMethod", DescribeMethodArgs{"Foo.Sum"}, &method)
+	_assert(err == nil && method.ServiceMethod == "Foo.Sum", "failed to describe Foo.Sum: %v", err)
+	arg, reply := method.ArgType, method.ReplyType
+	_assert(arg.Name == "geerpc.Args" && arg.Kind == "struct" && len(arg.Fields) == 2 && arg.Fields[0].Name == "Num1" &&
+		arg.Fields[0].Type.Kind == "int", "wrong arg type %+v", arg)
+	_assert(reply.Kind == "ptr" && reply.Elem.Kind == "int", "wrong reply type %+v", reply)
+	err = client.Call(context.Background(), ReflectionService+".DescribeMethod", DescribeMethodArgs{"Foo.Unknown"}, &method)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect an unknown method, got %v", err)
+}
@@ -0,0 +1,207 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiPath is the versioned json API of GeeRegistry, relative to the registry path:
+//
+//	GET    /v1/instances[?service=Foo]  list alive instances, add index=N to watch them, see serveWatch
+//	POST   /v1/instances                register an instance or renew it, ServerItem in body
+//	GET    /v1/instances/{addr}         get an instance
+//	PUT    /v1/instances/{addr}         register an instance or renew it, ServerItem in body
+//	DELETE /v1/instances/{addr}         deregister an instance
+//
+// {addr} is the path escaped address, eg. tcp@10.0.0.1:9999 or unix@%2Ftmp%2Fgeerpc.sock.
+// Every request may add ?namespace=staging, a registration may set the namespace
+// of the ServerItem instead, see DefaultNamespace.
+// Errors are returned as {"error": "..."} with a proper status code.
+const apiPath = "/v1/instances"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, apiError{Error: msg})
+}
+
+// serveAPI serves the json API, rest is the escaped path following apiPath.
+func (r *GeeRegistry) serveAPI(w http.ResponseWriter, req *http.Request, rest string) {
+	if rest == "" || rest == "/" {
+		switch req.Method {
+		case "GET":
+			namespace, ok := r.namespace(w, req, req.URL.Query().Get("namespace"))
+			if !ok {
+				return
+			}
+			if req.URL.Query().Get("index") != "" {
+				r.serveWatch(w, req, namespace)
+				return
+			}
+			r.list(w, namespace, req.URL.Query().Get("service"))
+		case "POST":
+			r.registerItem(w, req, "")
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method "+req.Method+" not allowed")
+		}
+		return
+	}
+
+	addr, err := url.PathUnescape(strings.TrimPrefix(rest, "/"))
+	if err != nil || addr == "" || strings.Contains(rest[1:], "/") {
+		writeError(w, http.StatusNotFound, "invalid instance path "+rest)
+		return
+	}
+	if req.Method == "PUT" {
+		r.registerItem(w, req, addr)
+		return
+	}
+	namespace, ok := r.namespace(w, req, req.URL.Query().Get("namespace"))
+	if !ok {
+		return
+	}
+	key := instanceKey{namespace, addr}
+	switch req.Method {
+	case "GET":
+		item, ok := r.getServer(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, "instance "+addr+" not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+	case "DELETE":
+		ok, err := r.deregister(key)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "instance "+addr+" not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method "+req.Method+" not allowed")
+	}
+}
+
+// registerItem registers the ServerItem in the body of req, addr, if not empty,
+// is the address in the path, the address in the body must match it.
+func (r *GeeRegistry) registerItem(w http.ResponseWriter, req *http.Request, addr string) {
+	var item ServerItem
+	if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid instance: "+err.Error())
+		return
+	}
+	if item.Addr == "" {
+		item.Addr = addr
+	}
+	if item.Addr == "" {
+		writeError(w, http.StatusBadRequest, "missing instance address")
+		return
+	}
+	if addr != "" && item.Addr != addr {
+		writeError(w, http.StatusBadRequest, "instance address "+item.Addr+" doesn't match path "+addr)
+		return
+	}
+	ns := req.URL.Query().Get("namespace")
+	if item.Namespace != "" && ns != "" && item.Namespace != ns {
+		writeError(w, http.StatusBadRequest, "instance namespace "+item.Namespace+" doesn't match "+ns)
+		return
+	}
+	if item.Namespace == "" {
+		item.Namespace = ns
+	}
+	var ok bool
+	if item.Namespace, ok = r.namespace(w, req, item.Namespace); !ok {
+		return
+	}
+	created, err := r.register(&item)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	saved, _ := r.getServer(keyOf(&item))
+	if created {
+		writeJSON(w, http.StatusCreated, saved)
+		return
+	}
+	writeJSON(w, http.StatusOK, saved)
+}
+
+// register registers item or renews it with its metadata, through the cluster if any.
+// The namespace of item must be set.
+func (r *GeeRegistry) register(item *ServerItem) (created bool, err error) {
+	if r.cluster == nil {
+		return r.putServer(keyOf(item), func(s *ServerItem) { s.setMetadata(item) }), nil
+	}
+	_, ok := r.getServer(keyOf(item))
+	return !ok, r.cluster.propose(clusterEntry{Op: opRegister, Namespace: item.Namespace, Addr: item.Addr, Item: item})
+}
+
+// renew renews key, or registers it without metadata. services, if not empty,
+// replace the services of key.
+func (r *GeeRegistry) renew(key instanceKey, services []string) error {
+	if r.cluster == nil {
+		var update func(s *ServerItem)
+		if len(services) > 0 {
+			update = func(s *ServerItem) { s.Services, s.Methods = parseServices(services) }
+		}
+		r.putServer(key, update)
+		return nil
+	}
+	if len(services) == 0 {
+		return r.cluster.propose(clusterEntry{Op: opRenew, Namespace: key.namespace, Addr: key.addr})
+	}
+	// the entry carries the whole metadata, keep the current one
+	item, _ := r.getServer(key)
+	item.Namespace, item.Addr = key.namespace, key.addr
+	item.Services, item.Methods = parseServices(services)
+	return r.cluster.propose(clusterEntry{Op: opRegister, Namespace: key.namespace, Addr: key.addr, Item: &item})
+}
+
+// deregister removes key, through the cluster if any, and returns false if it's not registered.
+func (r *GeeRegistry) deregister(key instanceKey) (bool, error) {
+	if r.cluster == nil {
+		return r.removeServer(key), nil
+	}
+	if _, ok := r.getServer(key); !ok {
+		return false, nil
+	}
+	return true, r.cluster.propose(clusterEntry{Op: opDeregister, Namespace: key.namespace, Addr: key.addr})
+}
+
+// getServer returns a copy of key if it's alive.
+func (r *GeeRegistry) getServer(key instanceKey) (ServerItem, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.servers[key]
+	if s == nil || (r.timeout != 0 && s.start.Add(r.timeout).Before(time.Now())) {
+		return ServerItem{}, false
+	}
+	return *s, true
+}
+
+// removeServer deregisters key, and returns false if it's not registered.
+func (r *GeeRegistry) removeServer(key instanceKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.servers[key]
+	if !ok {
+		return false
+	}
+	delete(r.servers, key)
+	r.record(EventDeregistered, s)
+	return true
+}
@@ -0,0 +1,720 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cluster of registries replicates the servers with a simplified Raft:
+// the nodes elect a leader by majority vote, every write (register, renew,
+// deregister) is appended to the log of the leader, replicated to the
+// followers and applied by every node once a majority has it.
+// Followers serve reads from their own state and redirect writes to the leader,
+// clients fail over between the nodes, see Endpoints.
+// The log is kept in memory and compacted into a snapshot of the servers,
+// a restarted node catches up from the leader.
+// The term and the vote of a node are not persisted either: a node restarted
+// during an election may vote a second time in the same term, and two leaders
+// of that term may be elected. Wait for a leader to be elected before
+// restarting another node.
+//
+// Nodes talk to each other in json under the registry path:
+//
+//	POST /raft/vote    request a vote
+//	POST /raft/append  append entries or install a snapshot, also the heartbeat of the leader
+//	GET  /raft/status  ClusterStatus of the node
+const raftPath = "/raft"
+
+const (
+	roleFollower  = "follower"
+	roleCandidate = "candidate"
+	roleLeader    = "leader"
+
+	opRenew = "renew"
+	opNoop  = "noop" // appended by a new leader to commit the entries of previous terms
+
+	maxLogEntries    = 1024 // the log is compacted beyond, see compact
+	maxAppendEntries = 256  // max entries sent in an append request
+)
+
+var (
+	errNoLeader        = errors.New("rpc registry: no cluster leader")
+	errNotLeader       = errors.New("rpc registry: not the cluster leader")
+	errLostLeadership  = errors.New("rpc registry: lost cluster leadership")
+	errCommitTimeout   = errors.New("rpc registry: cluster commit timeout")
+	errClusterStopped  = errors.New("rpc registry: cluster node stopped")
+	errInvalidPeerList = errors.New("rpc registry: cluster id must be one of the peers")
+)
+
+// ClusterOption configures a node of a registry cluster.
+type ClusterOption struct {
+	ID                string            // id of this node, a key of Peers
+	Peers             map[string]string // registry address of every node by id, including this one
+	HeartbeatInterval time.Duration     // time between two heartbeats of the leader, the election timeout is 5 to 10 times more
+	CommitTimeout     time.Duration     // max time a write waits to be replicated to a majority
+}
+
+var DefaultClusterOption = &ClusterOption{
+	HeartbeatInterval: time.Millisecond * 100,
+	CommitTimeout:     time.Second * 5,
+}
+
+// ClusterStatus is the state of a node of a registry cluster.
+type ClusterStatus struct {
+	ID          string `json:"id"`
+	Role        string `json:"role"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader,omitempty"`
+	CommitIndex uint64 `json:"commit_index"`
+	LastApplied uint64 `json:"last_applied"`
+}
+
+// clusterEntry is an entry of the replicated log, Time is the time of the
+// heartbeat, so that every node expires the server at the same time.
+type clusterEntry struct {
+	Index     uint64      `json:"index"`
+	Term      uint64      `json:"term"`
+	Op        string      `json:"op"`
+	Namespace string      `json:"namespace,omitempty"`
+	Addr      string      `json:"addr,omitempty"`
+	Item      *ServerItem `json:"item,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// replicaItem is a server in a snapshot, with the time of its last heartbeat.
+type replicaItem struct {
+	ServerItem
+	Renewed time.Time `json:"renewed"`
+}
+
+type clusterSnapshot struct {
+	Index   uint64        `json:"index"`
+	Term    uint64        `json:"term"`
+	Servers []replicaItem `json:"servers"`
+}
+
+type voteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendArgs struct {
+	Term         uint64           `json:"term"`
+	LeaderID     string           `json:"leader_id"`
+	PrevLogIndex uint64           `json:"prev_log_index"`
+	PrevLogTerm  uint64           `json:"prev_log_term"`
+	Entries      []clusterEntry   `json:"entries,omitempty"`
+	LeaderCommit uint64           `json:"leader_commit"`
+	Snapshot     *clusterSnapshot `json:"snapshot,omitempty"` // sent instead of entries compacted away
+}
+
+type appendReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"` // where the leader should retry from
+}
+
+// raftNode is the consensus of a registry created by NewCluster.
+type raftNode struct {
+	r      *GeeRegistry
+	opt    ClusterOption
+	client *http.Client
+
+	mu              sync.Mutex // protect following
+	role            string
+	term            uint64
+	votedFor        string
+	leader          string
+	log             []clusterEntry // log[0] is the last compacted entry, only its index and term are kept
+	snapshot        *clusterSnapshot
+	commitIndex     uint64
+	lastApplied     uint64
+	nextIndex       map[string]uint64
+	matchIndex      map[string]uint64
+	sending         map[string]bool // an append request to the peer is in flight
+	lastContact     time.Time       // last time the leader was heard or a vote was granted
+	electionTimeout time.Duration
+	waiters         map[uint64]chan error // proposals waiting to be applied, by index
+	done            chan struct{}
+	stopped         chan struct{}
+	stopOnce        sync.Once
+}
+
+// NewCluster creates a registry like New, as the node opt.ID of a cluster of opt.Peers.
+// Every node must be served on its address in opt.Peers, eg. with HandleHTTP.
+// Close the registry to stop the node.
+func NewCluster(timeout time.Duration, opt *ClusterOption) (*GeeRegistry, error) {
+	if opt == nil {
+		return nil, errInvalidPeerList
+	}
+	o := *opt
+	if _, ok := o.Peers[o.ID]; !ok {
+		return nil, errInvalidPeerList
+	}
+	if o.HeartbeatInterval <= 0 {
+		o.HeartbeatInterval = DefaultClusterOption.HeartbeatInterval
+	}
+	if o.CommitTimeout <= 0 {
+		o.CommitTimeout = DefaultClusterOption.CommitTimeout
+	}
+	r := New(timeout)
+	n := &raftNode{
+		r:           r,
+		opt:         o,
+		client:      &http.Client{Timeout: o.HeartbeatInterval * 5},
+		role:        roleFollower,
+		log:         []clusterEntry{{}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		sending:     make(map[string]bool),
+		lastContact: time.Now(),
+		waiters:     make(map[uint64]chan error),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	n.resetElectionTimeout()
+	r.cluster = n
+	go n.run()
+	return r, nil
+}
+
+// ClusterStatus returns the state of the cluster node, zero if r is not a cluster node.
+func (r *GeeRegistry) ClusterStatus() ClusterStatus {
+	if r.cluster == nil {
+		return ClusterStatus{}
+	}
+	return r.cluster.status()
+}
+
+func (n *raftNode) status() ClusterStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return ClusterStatus{
+		ID:          n.opt.ID,
+		Role:        n.role,
+		Term:        n.term,
+		Leader:      n.leader,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+	}
+}
+
+func (n *raftNode) stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		<-n.stopped
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.role, n.leader = roleFollower, ""
+		n.failWaiters(errClusterStopped)
+	})
+}
+
+func (n *raftNode) run() {
+	defer close(n.stopped)
+	t := time.NewTicker(n.opt.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == roleLeader:
+			n.mu.Unlock()
+			n.replicate()
+		case time.Since(n.lastContact) >= n.electionTimeout:
+			n.mu.Unlock()
+			n.elect()
+		default:
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *raftNode) resetElectionTimeout() {
+	n.electionTimeout = n.opt.HeartbeatInterval * time.Duration(5+rand.Intn(5))
+}
+
+func (n *raftNode) lastIndex() uint64 { return n.log[len(n.log)-1].Index }
+
+// entry returns the entry at index, which must be in the log.
+func (n *raftNode) entry(index uint64) *clusterEntry { return &n.log[index-n.log[0].Index] }
+
+func (n *raftNode) majority() int { return len(n.opt.Peers)/2 + 1 }
+
+// stepDown follows term. n.mu must be held.
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+	}
+	if n.role == roleLeader {
+		log.Printf("rpc registry: %s is no longer the cluster leader", n.opt.ID)
+		n.failWaiters(errLostLeadership)
+	}
+	n.role = roleFollower
+}
+
+func (n *raftNode) failWaiters(err error) {
+	for index, ch := range n.waiters {
+		ch <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *raftNode) elect() {
+	n.mu.Lock()
+	n.role = roleCandidate
+	n.term++
+	n.votedFor = n.opt.ID
+	n.leader = ""
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	args := voteArgs{
+		Term:         n.term,
+		CandidateID:  n.opt.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[len(n.log)-1].Term,
+	}
+	n.mu.Unlock()
+
+	votes := make(chan bool, len(n.opt.Peers))
+	for id := range n.opt.Peers {
+		if id == n.opt.ID {
+			continue
+		}
+		go func(id string) {
+			var reply voteReply
+			if err := n.call(id, "/vote", &args, &reply); err != nil {
+				votes <- false
+				return
+			}
+			n.mu.Lock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+			}
+			n.mu.Unlock()
+			votes <- reply.Granted
+		}(id)
+	}
+	granted := 1
+	for i := 1; i < len(n.opt.Peers) && granted < n.majority(); i++ {
+		if <-votes {
+			granted++
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if granted < n.majority() || n.role != roleCandidate || n.term != args.Term {
+		return
+	}
+	log.Printf("rpc registry: %s is the cluster leader of term %d", n.opt.ID, n.term)
+	n.role = roleLeader
+	n.leader = n.opt.ID
+	for id := range n.opt.Peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	n.appendEntry(clusterEntry{Op: opNoop})
+	go n.replicate()
+}
+
+// appendEntry appends e to the log of the leader. n.mu must be held.
+func (n *raftNode) appendEntry(e clusterEntry) uint64 {
+	e.Index = n.lastIndex() + 1
+	e.Term = n.term
+	n.log = append(n.log, e)
+	n.matchIndex[n.opt.ID] = e.Index
+	n.advanceCommit()
+	return e.Index
+}
+
+// propose appends e to the log, and waits for it to be applied.
+func (n *raftNode) propose(e clusterEntry) error {
+	e.Time = time.Now()
+	n.mu.Lock()
+	if n.role != roleLeader {
+		leader := n.leader
+		n.mu.Unlock()
+		if leader == "" {
+			return errNoLeader
+		}
+		return fmt.Errorf("%w, write to %s", errNotLeader, n.opt.Peers[leader])
+	}
+	ch := make(chan error, 1)
+	n.waiters[n.lastIndex()+1] = ch
+	n.appendEntry(e)
+	n.mu.Unlock()
+	go n.replicate()
+
+	t := time.NewTimer(n.opt.CommitTimeout)
+	defer t.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-t.C:
+		return errCommitTimeout
+	}
+}
+
+func (n *raftNode) replicate() {
+	for id := range n.opt.Peers {
+		if id != n.opt.ID {
+			go n.sendAppend(id)
+		}
+	}
+}
+
+func (n *raftNode) sendAppend(id string) {
+	n.mu.Lock()
+	if n.role != roleLeader || n.sending[id] {
+		n.mu.Unlock()
+		return
+	}
+	n.sending[id] = true
+	args := appendArgs{Term: n.term, LeaderID: n.opt.ID, LeaderCommit: n.commitIndex}
+	next := n.nextIndex[id]
+	if next <= n.log[0].Index {
+		// the entries are compacted away, send the snapshot
+		args.Snapshot = n.snapshot
+	} else {
+		prev := n.entry(next - 1)
+		args.PrevLogIndex, args.PrevLogTerm = prev.Index, prev.Term
+		for i := next; i <= n.lastIndex() && len(args.Entries) < maxAppendEntries; i++ {
+			args.Entries = append(args.Entries, *n.entry(i))
+		}
+	}
+	n.mu.Unlock()
+
+	var reply appendReply
+	err := n.call(id, "/append", &args, &reply)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sending[id] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+	if n.role != roleLeader || n.term != args.Term {
+		return
+	}
+	if !reply.Success {
+		if reply.ConflictIndex > 0 && reply.ConflictIndex < next {
+			next = reply.ConflictIndex
+		} else if next > 1 {
+			next--
+		}
+		n.nextIndex[id] = next
+		return
+	}
+	match := args.PrevLogIndex + uint64(len(args.Entries))
+	if args.Snapshot != nil {
+		match = args.Snapshot.Index
+	}
+	if match > n.matchIndex[id] {
+		n.matchIndex[id] = match
+	}
+	n.nextIndex[id] = n.matchIndex[id] + 1
+	n.advanceCommit()
+}
+
+// advanceCommit commits the entries of the current term on a majority. n.mu must be held.
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.log[0].Index; index-- {
+		if n.entry(index).Term != n.term {
+			break // entries of previous terms are committed by the ones of this term
+		}
+		count := 0
+		for id := range n.opt.Peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.apply()
+			return
+		}
+	}
+}
+
+// apply applies the committed entries to the registry. n.mu must be held.
+func (n *raftNode) apply() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		e := n.entry(n.lastApplied)
+		key := instanceKey{e.Namespace, e.Addr}
+		switch e.Op {
+		case opRegister:
+			item := *e.Item
+			n.r.putServerAt(key, e.Time, func(s *ServerItem) { s.setMetadata(&item) })
+		case opRenew:
+			n.r.putServerAt(key, e.Time, nil)
+		case opDeregister:
+			n.r.removeServer(key)
+		}
+		if ch, ok := n.waiters[e.Index]; ok {
+			if e.Term == n.term && n.role == roleLeader {
+				ch <- nil
+			} else {
+				ch <- errLostLeadership
+			}
+			delete(n.waiters, e.Index)
+		}
+	}
+	n.compact()
+}
+
+// compact replaces the applied entries with a snapshot of the servers once the log is too long.
+// n.mu must be held.
+func (n *raftNode) compact() {
+	if len(n.log) <= maxLogEntries || n.lastApplied <= n.log[0].Index {
+		return
+	}
+	last := n.entry(n.lastApplied)
+	n.snapshot = &clusterSnapshot{Index: last.Index, Term: last.Term, Servers: n.r.replicaItems()}
+	n.log = append([]clusterEntry{{Index: last.Index, Term: last.Term}}, n.log[last.Index-n.log[0].Index+1:]...)
+}
+
+func (n *raftNode) handleVote(args *voteArgs) voteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// ignore candidates while the leader is alive, eg. a node back from a partition
+	if n.role == roleLeader || (n.leader != "" && time.Since(n.lastContact) < n.opt.HeartbeatInterval*5) {
+		return voteReply{Term: n.term}
+	}
+	if args.Term > n.term {
+		n.stepDown(args.Term)
+	}
+	reply := voteReply{Term: n.term}
+	if args.Term < n.term || (n.votedFor != "" && n.votedFor != args.CandidateID) {
+		return reply
+	}
+	// only vote for a candidate whose log is at least as up-to-date
+	last := n.log[len(n.log)-1]
+	if args.LastLogTerm < last.Term || (args.LastLogTerm == last.Term && args.LastLogIndex < last.Index) {
+		return reply
+	}
+	n.votedFor = args.CandidateID
+	n.lastContact = time.Now()
+	reply.Granted = true
+	return reply
+}
+
+func (n *raftNode) handleAppend(args *appendArgs) appendReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if args.Term < n.term {
+		return appendReply{Term: n.term}
+	}
+	if args.Term > n.term || n.role != roleFollower {
+		n.stepDown(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.lastContact = time.Now()
+	reply := appendReply{Term: n.term}
+
+	if s := args.Snapshot; s != nil {
+		if s.Index > n.lastApplied {
+			n.snapshot = s
+			n.log = []clusterEntry{{Index: s.Index, Term: s.Term}}
+			n.commitIndex, n.lastApplied = s.Index, s.Index
+			n.r.replaceServers(s.Servers)
+		}
+		reply.Success = true
+		return reply
+	}
+
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if args.PrevLogIndex >= n.log[0].Index && n.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
+		reply.ConflictIndex = args.PrevLogIndex
+		return reply
+	}
+	for i, e := range args.Entries {
+		if e.Index <= n.log[0].Index {
+			continue // already compacted, so committed
+		}
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-n.log[0].Index] // conflict, drop it and all that follow
+		}
+		n.log = append(n.log, args.Entries[i:]...)
+		break
+	}
+	reply.Success = true
+	// commit up to the last entry known to match the leader, a delayed
+	// request must not move the commit index backwards
+	commit := args.PrevLogIndex + uint64(len(args.Entries))
+	if args.LeaderCommit < commit {
+		commit = args.LeaderCommit
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.apply()
+	}
+	return reply
+}
+
+// call sends a json request to the node id.
+func (n *raftNode) call(id, path string, args, reply interface{}) error {
+	body, _ := json.Marshal(args)
+	resp, err := n.client.Post(n.opt.Peers[id]+raftPath+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc registry: cluster %s status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// ServeHTTP serves the requests of the other nodes, rest is the path following raftPath.
+func (n *raftNode) ServeHTTP(w http.ResponseWriter, req *http.Request, rest string) {
+	select {
+	case <-n.done:
+		writeError(w, http.StatusServiceUnavailable, errClusterStopped.Error())
+		return
+	default:
+	}
+	switch {
+	case rest == "/vote" && req.Method == "POST":
+		var args voteArgs
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, n.handleVote(&args))
+	case rest == "/append" && req.Method == "POST":
+		var args appendArgs
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, n.handleAppend(&args))
+	case rest == "/status" && req.Method == "GET":
+		writeJSON(w, http.StatusOK, n.status())
+	default:
+		writeError(w, http.StatusNotFound, "invalid cluster path "+rest)
+	}
+}
+
+// waitLeader returns the role of the node and the leader, waiting up to
+// twice the max election timeout while no leader is known, eg. during an election.
+func (n *raftNode) waitLeader() (role, leader string) {
+	t := time.NewTimer(n.opt.HeartbeatInterval * 20)
+	defer t.Stop()
+	for {
+		n.mu.Lock()
+		role, leader = n.role, n.leader
+		n.mu.Unlock()
+		if leader != "" {
+			return
+		}
+		select {
+		case <-n.done:
+			return
+		case <-t.C:
+			return
+		case <-time.After(n.opt.HeartbeatInterval):
+		}
+	}
+}
+
+// redirect sends writes to the leader, and returns true if this node is the leader.
+// Writes received while no leader is known wait for the election.
+func (n *raftNode) redirect(w http.ResponseWriter, req *http.Request) bool {
+	select {
+	case <-n.done:
+		writeError(w, http.StatusServiceUnavailable, errClusterStopped.Error())
+		return false
+	default:
+	}
+	role, leader := n.waitLeader()
+	if role == roleLeader {
+		return true
+	}
+	if leader == "" {
+		writeError(w, http.StatusServiceUnavailable, errNoLeader.Error())
+		return false
+	}
+	// keep the path following the registry path, eg. /v1/instances/{addr}
+	target := n.opt.Peers[leader]
+	if i := strings.Index(req.URL.EscapedPath(), apiPath); i >= 0 {
+		target += req.URL.EscapedPath()[i:]
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	// 307 makes clients send the same method and body again
+	http.Redirect(w, req, target, http.StatusTemporaryRedirect)
+	return false
+}
+
+// replicaItems returns the servers with the time of their last heartbeat.
+func (r *GeeRegistry) replicaItems() []replicaItem {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := make([]replicaItem, 0, len(r.servers))
+	for _, s := range r.servers {
+		items = append(items, replicaItem{ServerItem: *s, Renewed: s.start})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+		return items[i].Addr < items[j].Addr
+	})
+	return items
+}
+
+// replaceServers replaces all the servers with items.
+func (r *GeeRegistry) replaceServers(items []replicaItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.servers
+	r.servers = make(map[instanceKey]*ServerItem, len(items))
+	for _, item := range items {
+		s := item.ServerItem
+		s.start = item.Renewed
+		r.servers[keyOf(&s)] = &s
+		if _, ok := old[keyOf(&s)]; !ok {
+			r.publish(EventRegistered, &s)
+		}
+	}
+	for key, s := range old {
+		if _, ok := r.servers[key]; !ok {
+			r.publish(EventDeregistered, s)
+		}
+	}
+	r.bump()
+	r.startReaper()
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clusterNode is a node of a test cluster served on loopback, partitioned
+// nodes fail every request they receive.
+type clusterNode struct {
+	*GeeRegistry
+	url         string
+	srv         *http.Server
+	partitioned int32
+}
+
+func (c *clusterNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&c.partitioned) == 1 {
+		writeError(w, http.StatusServiceUnavailable, "partitioned")
+		return
+	}
+	c.GeeRegistry.ServeHTTP(w, req)
+}
+
+func (c *clusterNode) stop() {
+	_ = c.Close()
+	_ = c.srv.Close()
+}
+
+func startCluster(n int) []*clusterNode {
+	peers := make(map[string]string)
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		listeners[i], _ = net.Listen("tcp", "127.0.0.1:0")
+		peers[fmt.Sprint(i)] = "http://" + listeners[i].Addr().String() + defaultPath
+	}
+	nodes := make([]*clusterNode, n)
+	for i := range nodes {
+		r, err := NewCluster(time.Minute, &ClusterOption{
+			ID:                fmt.Sprint(i),
+			Peers:             peers,
+			HeartbeatInterval: time.Millisecond * 20,
+		})
+		_assert(err == nil, "failed to create node: %v", err)
+		nodes[i] = &clusterNode{GeeRegistry: r, url: peers[fmt.Sprint(i)]}
+		nodes[i].srv = &http.Server{Handler: nodes[i]}
+		go func(i int) { _ = nodes[i].srv.Serve(listeners[i]) }(i)
+	}
+	return nodes
+}
+
+// leaderOf waits for a single leader among nodes, known by all of them,
+// and returns its index.
+func leaderOf(nodes []*clusterNode) int {
+	for i := 0; i < 300; i++ {
+		leader, count := -1, 0
+		status := make([]ClusterStatus, len(nodes))
+		for j, node := range nodes {
+			status[j] = node.ClusterStatus()
+			if status[j].Role == roleLeader {
+				leader = j
+				count++
+			}
+		}
+		agreed := count == 1
+		for j := 0; agreed && j < len(nodes); j++ {
+			agreed = status[j].Leader == status[leader].ID && status[j].Term == status[leader].Term
+		}
+		if agreed {
+			return leader
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	panic("expect a cluster leader to be elected")
+}
+
+func TestCluster(t *testing.T) {
+	nodes := startCluster(3)
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := leaderOf(nodes)
+	follower := (leader + 1) % 3
+
+	// a write to a follower is redirected to the leader and replicated
+	h := Heartbeat(nodes[follower].url, "tcp@foo:1", time.Minute, "Foo")
+	defer func() { _ = h.Stop() }()
+	_assert(h.Status()[0].Registered, "expect to register through a follower, got %+v", h.Status()[0])
+	for _, node := range nodes {
+		waitFor(func() bool { return list(node.GeeRegistry, "") == "tcp@foo:1" }, "expect every node to have the server")
+	}
+
+	// the others elect a new leader once the leader stops, clients fail over
+	nodes[leader].stop()
+	alive := append(append([]*clusterNode{}, nodes[:leader]...), nodes[leader+1:]...)
+	newLeader := alive[leaderOf(alive)]
+	_assert(newLeader.ClusterStatus().Term > 1, "expect a new term")
+	h2 := Heartbeat(nodes[leader].url+","+alive[0].url+","+alive[1].url, "tcp@bar:1", time.Minute)
+	defer func() { _ = h2.Stop() }()
+	_assert(h2.Status()[0].Registered, "expect to fail over, got %+v", h2.Status()[0])
+	for _, node := range alive {
+		waitFor(func() bool { return list(node.GeeRegistry, "") == "tcp@bar:1,tcp@foo:1" }, "expect the new leader to replicate")
+	}
+
+	// deregistration is replicated too
+	_assert(h.Stop() == nil, "expect to deregister")
+	for _, node := range alive {
+		waitFor(func() bool { return list(node.GeeRegistry, "") == "tcp@bar:1" }, "expect deregistration to be replicated")
+	}
+}
+
+func TestCluster_snapshot(t *testing.T) {
+	nodes := startCluster(3)
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := leaderOf(nodes)
+	lagging := nodes[(leader+1)%3]
+	atomic.StoreInt32(&lagging.partitioned, 1)
+
+	// enough writes to compact the log of the leader
+	for i := 0; i <= maxLogEntries; i++ {
+		_assert(nodes[leader].renew(instanceKey{DefaultNamespace, fmt.Sprintf("tcp@foo:%d", i%10)}, nil) == nil, "expect the write to be committed")
+	}
+	n := nodes[leader].cluster
+	n.mu.Lock()
+	compacted := n.snapshot != nil && len(n.log) < maxLogEntries
+	n.mu.Unlock()
+	_assert(compacted, "expect the log to be compacted")
+
+	// the lagging node catches up from the snapshot
+	atomic.StoreInt32(&lagging.partitioned, 0)
+	leader = leaderOf(nodes)
+	waitFor(func() bool {
+		return lagging.ClusterStatus().LastApplied >= nodes[leader].ClusterStatus().CommitIndex-1
+	}, "expect the lagging node to catch up")
+	_assert(list(lagging.GeeRegistry, "") == list(nodes[leader].GeeRegistry, ""), "expect the same servers")
+}
+
+func TestCluster_handleAppend(t *testing.T) {
+	// the other peer doesn't exist, so that the node never becomes leader
+	r, err := NewCluster(time.Minute, &ClusterOption{
+		ID:                "0",
+		Peers:             map[string]string{"0": "http://127.0.0.1:1", "1": "http://127.0.0.1:1"},
+		HeartbeatInterval: time.Hour,
+	})
+	_assert(err == nil, "failed to create node: %v", err)
+	defer func() { _ = r.Close() }()
+	n := r.cluster
+	entries := []clusterEntry{{Index: 1, Term: 1, Op: opNoop}, {Index: 2, Term: 1, Op: opNoop}, {Index: 3, Term: 1, Op: opNoop}}
+	reply := n.handleAppend(&appendArgs{Term: 1, LeaderID: "1", Entries: entries, LeaderCommit: 3})
+	_assert(reply.Success && r.ClusterStatus().CommitIndex == 3, "expect to commit the entries, got %+v", r.ClusterStatus())
+
+	// a delayed request only matching up to index 1 doesn't move the commit back
+	reply = n.handleAppend(&appendArgs{Term: 1, LeaderID: "1", PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 4})
+	status := r.ClusterStatus()
+	_assert(reply.Success && status.CommitIndex == 3 && status.LastApplied == 3, "expect the commit index to stay, got %+v", status)
+}
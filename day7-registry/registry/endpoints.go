@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Endpoints are the addresses of the nodes of a registry cluster, given comma
+// separated as a single registry address, eg.
+// "http://10.0.0.1:9999/_geerpc_/registry,http://10.0.0.2:9999/_geerpc_/registry".
+// Requests go to the node that answered last, and fail over to the others.
+type Endpoints struct {
+	mu      sync.Mutex
+	addrs   []string
+	current int // index of the node that answered last
+}
+
+// NewEndpoints creates the Endpoints of registry, a single address or a comma separated list.
+func NewEndpoints(registry string) *Endpoints {
+	e := &Endpoints{}
+	for _, addr := range strings.Split(registry, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			e.addrs = append(e.addrs, addr)
+		}
+	}
+	return e
+}
+
+// Do calls f with every node in turn, from the one that answered last, until f succeeds.
+// It returns the error of the last node tried.
+func (e *Endpoints) Do(f func(registry string) error) error {
+	e.mu.Lock()
+	start := e.current
+	e.mu.Unlock()
+	err := errors.New("rpc registry: no registry address")
+	for i := range e.addrs {
+		n := (start + i) % len(e.addrs)
+		if err = f(e.addrs[n]); err == nil {
+			e.mu.Lock()
+			e.current = n
+			e.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of change of a server in the registry.
+type EventType string
+
+const (
+	EventRegistered   EventType = "registered"   // a server is added
+	EventRenewed      EventType = "renewed"      // a server sent a heartbeat, maybe with new metadata
+	EventExpired      EventType = "expired"      // a server stopped sending heartbeats and is removed
+	EventDeregistered EventType = "deregistered" // a server is removed on request
+)
+
+// Event is a change of a server, Index is the revision of the registry after it.
+type Event struct {
+	Type  EventType  `json:"type"`
+	Item  ServerItem `json:"item"`
+	Time  time.Time  `json:"time"`
+	Index uint64     `json:"index"`
+}
+
+// Subscription receives the events of a registry on C until it's closed.
+// Events are never blocked by a slow subscriber: they are dropped when
+// the buffer of C is full, and counted by Dropped.
+type Subscription struct {
+	C <-chan Event
+
+	r       *GeeRegistry
+	c       chan Event
+	dropped uint64
+}
+
+// Subscribe subscribes to the events of r, buffer is the capacity of the channel.
+func (r *GeeRegistry) Subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, r: r, c: c}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribers == nil {
+		r.subscribers = make(map[*Subscription]struct{})
+	}
+	r.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Close unsubscribes, and closes C.
+func (sub *Subscription) Close() {
+	sub.r.mu.Lock()
+	defer sub.r.mu.Unlock()
+	if _, ok := sub.r.subscribers[sub]; ok {
+		delete(sub.r.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// Dropped returns the number of events dropped because C was full.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// publish sends an event of s to the subscribers. r.mu must be held.
+func (r *GeeRegistry) publish(typ EventType, s *ServerItem) {
+	if len(r.subscribers) == 0 {
+		return
+	}
+	e := Event{Type: typ, Item: *s, Time: time.Now(), Index: r.index}
+	for sub := range r.subscribers {
+		select {
+		case sub.c <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// record records a change of s: it increases the revision, appends it to
+// the write-ahead log if any, and publishes it. r.mu must be held.
+func (r *GeeRegistry) record(typ EventType, s *ServerItem) {
+	r.bump()
+	if typ == EventRegistered || typ == EventRenewed {
+		r.appendLog(opRegister, s)
+	} else {
+		r.appendLog(opDeregister, s)
+	}
+	r.publish(typ, s)
+}
+
+// expire removes the servers without heartbeat since timeout. r.mu must be held.
+func (r *GeeRegistry) expire(now time.Time) {
+	if r.timeout == 0 {
+		return
+	}
+	for addr, s := range r.servers {
+		if !s.start.Add(r.timeout).After(now) {
+			delete(r.servers, addr)
+			r.record(EventExpired, s)
+		}
+	}
+}
+
+// startReaper starts a goroutine expiring the servers on time, instead of
+// on the next list only. It's started by the first registration and
+// stopped by Close. r.mu must be held.
+func (r *GeeRegistry) startReaper() {
+	if r.reaper != nil || r.timeout == 0 {
+		return
+	}
+	r.reaper = make(chan struct{})
+	go r.runReaper(r.reaper)
+}
+
+func (r *GeeRegistry) stopReaper() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reaper != nil {
+		close(r.reaper)
+		r.reaper = nil
+	}
+}
+
+func (r *GeeRegistry) runReaper(done chan struct{}) {
+	for {
+		// sleep until the next server expires, the servers may change meanwhile
+		_, changed, expiry := r.revision()
+		var expired <-chan time.Time
+		var t *time.Timer
+		if !expiry.IsZero() {
+			t = time.NewTimer(time.Until(expiry))
+			expired = t.C
+		}
+		select {
+		case <-done:
+		case <-changed:
+		case <-expired:
+			r.mu.Lock()
+			r.expire(time.Now())
+			r.mu.Unlock()
+		}
+		if t != nil {
+			t.Stop()
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
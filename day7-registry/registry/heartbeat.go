@@ -0,0 +1,296 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Heartbeat registers addr in registry and sends it a heartbeat every duration,
+// 0 means 1 min less than the timeout of the registry.
+// services are the "Service" or "Service.Method" served by addr, discovery
+// only returns addr for these services, see geerpc.Server.ServiceMethods.
+// Stop the returned Heartbeater to deregister addr, eg. on geerpc.Server.RegisterOnShutdown.
+func Heartbeat(registry, addr string, duration time.Duration, services ...string) *Heartbeater {
+	return HeartbeatItem(registry, &ServerItem{Addr: addr, Services: services}, duration)
+}
+
+// HeartbeatItem is like Heartbeat, but registers the server with the metadata of item,
+// in the namespace of item.
+func HeartbeatItem(registry string, item *ServerItem, duration time.Duration) *Heartbeater {
+	h := NewHeartbeater([]string{registry}, item, &HeartbeatOption{Interval: duration})
+	h.Start(context.Background())
+	return h
+}
+
+// HeartbeatOption configures a Heartbeater.
+type HeartbeatOption struct {
+	Interval   time.Duration // time between two heartbeats, 0 means 1 min less than defaultTimeout
+	Timeout    time.Duration // timeout of a single request to the registry
+	MinBackoff time.Duration // delay before retrying a failed heartbeat, doubled on every failure
+	MaxBackoff time.Duration // max delay between retries, capped by Interval
+	Token      string        // token of the namespace of the server, if it's protected, see GeeRegistry.SetToken
+}
+
+var DefaultHeartbeatOption = &HeartbeatOption{
+	Interval:   defaultTimeout - time.Minute,
+	Timeout:    time.Second * 5,
+	MinBackoff: time.Millisecond * 500,
+	MaxBackoff: time.Second * 30,
+}
+
+// HeartbeatStatus is the state of the heartbeats sent to a registry.
+type HeartbeatStatus struct {
+	Registry      string
+	Registered    bool      // the last heartbeat succeeded
+	LastHeartbeat time.Time // time of the last successful heartbeat
+	LastError     error     // error of the last failed heartbeat, nil after a success
+	Failures      int       // consecutive failed heartbeats
+	Registrations int       // times the server was added to the registry, > 1 after the registry lost it, eg. on restart
+}
+
+// Heartbeater keeps a server registered to one or more registries: it sends
+// heartbeats on an interval, retries failed ones with exponential backoff,
+// and registers the server again if a registry lost it.
+// Every registry is independent, a registry being down doesn't delay the others.
+// A registry may be the comma separated nodes of a cluster, see Endpoints.
+type Heartbeater struct {
+	registries []string
+	item       *ServerItem
+	scope      Scope
+	opt        HeartbeatOption
+	client     *http.Client
+	endpoints  map[string]*Endpoints
+
+	mu      sync.Mutex // protect following
+	status  map[string]*HeartbeatStatus
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	stopped bool
+}
+
+// NewHeartbeater creates a Heartbeater of item to registries, nil opt means DefaultHeartbeatOption.
+func NewHeartbeater(registries []string, item *ServerItem, opt *HeartbeatOption) *Heartbeater {
+	if opt == nil {
+		opt = DefaultHeartbeatOption
+	}
+	h := &Heartbeater{
+		registries: registries,
+		item:       item,
+		scope:      Scope{Namespace: item.Namespace, Token: opt.Token},
+		opt:        *opt,
+		status:     make(map[string]*HeartbeatStatus),
+		endpoints:  make(map[string]*Endpoints),
+	}
+	if h.opt.Interval <= 0 {
+		h.opt.Interval = DefaultHeartbeatOption.Interval
+	}
+	if h.opt.Timeout <= 0 {
+		h.opt.Timeout = DefaultHeartbeatOption.Timeout
+	}
+	if h.opt.MinBackoff <= 0 {
+		h.opt.MinBackoff = DefaultHeartbeatOption.MinBackoff
+	}
+	if h.opt.MaxBackoff <= 0 {
+		h.opt.MaxBackoff = DefaultHeartbeatOption.MaxBackoff
+	}
+	if h.opt.MaxBackoff > h.opt.Interval {
+		h.opt.MaxBackoff = h.opt.Interval
+	}
+	h.client = &http.Client{Timeout: h.opt.Timeout}
+	for _, registry := range registries {
+		h.status[registry] = &HeartbeatStatus{Registry: registry}
+		h.endpoints[registry] = NewEndpoints(registry)
+	}
+	return h
+}
+
+// Start sends the first heartbeat to every registry, then keeps sending
+// heartbeats in the background until ctx is done or Stop is called.
+// Cancelling ctx doesn't deregister the server, it expires in the registries.
+func (h *Heartbeater) Start(ctx context.Context) {
+	h.mu.Lock()
+	if h.stopped || h.cancel != nil {
+		h.mu.Unlock()
+		return
+	}
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.running.Add(len(h.registries))
+	h.mu.Unlock()
+
+	var first sync.WaitGroup
+	first.Add(len(h.registries))
+	for _, registry := range h.registries {
+		go h.run(ctx, registry, &first)
+	}
+	first.Wait()
+}
+
+func (h *Heartbeater) run(ctx context.Context, registry string, first *sync.WaitGroup) {
+	defer h.running.Done()
+	delay := h.beat(ctx, registry)
+	first.Done()
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		delay = h.beat(ctx, registry)
+	}
+}
+
+// beat sends a heartbeat to registry, and returns the delay before the next one.
+func (h *Heartbeater) beat(ctx context.Context, registry string) time.Duration {
+	created, err := h.send(ctx, registry)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.status[registry]
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0 // stopped, keep the last status
+		}
+		s.Registered = false
+		s.LastError = err
+		s.Failures++
+		log.Printf("rpc server: heart beat to %s failed %d times: %v", registry, s.Failures, err)
+		return h.backoff(s.Failures)
+	}
+	if created {
+		s.Registrations++
+		if s.Registrations > 1 {
+			log.Println(h.item.Addr, "registered again to registry", registry)
+		}
+	}
+	s.Registered = true
+	s.LastHeartbeat = time.Now()
+	s.LastError = nil
+	s.Failures = 0
+	return h.opt.Interval
+}
+
+// backoff returns the delay before retrying after failures failed heartbeats,
+// with a random jitter of up to 20% to spread the retries of many servers.
+func (h *Heartbeater) backoff(failures int) time.Duration {
+	d := h.opt.MinBackoff
+	for i := 1; i < failures && d < h.opt.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > h.opt.MaxBackoff {
+		d = h.opt.MaxBackoff
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// send registers or renews the server, and reports whether the registry added it.
+func (h *Heartbeater) send(ctx context.Context, registry string) (created bool, err error) {
+	err = h.endpoints[registry].Do(func(addr string) error {
+		created, err = h.sendTo(ctx, addr)
+		return err
+	})
+	return
+}
+
+func (h *Heartbeater) sendTo(ctx context.Context, registry string) (created bool, err error) {
+	log.Println(h.item.Addr, "send heart beat to registry", registry)
+	body, err := json.Marshal(h.item)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", registry+apiPath, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.scope.SetHeader(req.Header)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusOK:
+		return false, nil
+	}
+	var e apiError
+	if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+		return false, fmt.Errorf("rpc registry: heart beat status %s: %s", resp.Status, e.Error)
+	}
+	return false, fmt.Errorf("rpc registry: heart beat status %s", resp.Status)
+}
+
+// Status returns the state of the heartbeats sent to every registry.
+func (h *Heartbeater) Status() []HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := make([]HeartbeatStatus, 0, len(h.registries))
+	for _, registry := range h.registries {
+		status = append(status, *h.status[registry])
+	}
+	return status
+}
+
+// Stop stops sending heartbeats and deregisters the server from every registry
+// immediately, instead of letting it expire. It returns the first error.
+func (h *Heartbeater) Stop() error {
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return nil
+	}
+	h.stopped = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.mu.Unlock()
+	h.running.Wait() // a heartbeat sent after deregistration would register it again
+
+	var err error
+	for _, registry := range h.registries {
+		if e := h.deregister(registry); e != nil && err == nil {
+			err = e
+		}
+		h.mu.Lock()
+		h.status[registry].Registered = false
+		h.mu.Unlock()
+	}
+	return err
+}
+
+func (h *Heartbeater) deregister(registry string) error {
+	return h.endpoints[registry].Do(h.deregisterFrom)
+}
+
+func (h *Heartbeater) deregisterFrom(registry string) error {
+	log.Println(h.item.Addr, "deregister from registry", registry)
+	path := registry + apiPath + "/" + url.PathEscape(h.item.Addr)
+	if q := h.scope.Query(); len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	req, _ := http.NewRequest("DELETE", path, nil)
+	h.scope.SetHeader(req.Header)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Println("rpc server: deregister err", err)
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// not found means it has already expired
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		err = fmt.Errorf("rpc registry: deregister status %s", resp.Status)
+		log.Println(err)
+		return err
+	}
+	return nil
+}
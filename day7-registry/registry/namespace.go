@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// Servers are registered in a namespace, eg. an environment or a team, so that
+// a staging server never joins the production traffic of the same registry.
+// Discovery only returns the servers of its namespace, the same address may be
+// registered in several namespaces. Servers without namespace are in DefaultNamespace.
+//
+// The json API, the header protocol and the watches select a namespace with
+// ?namespace=staging. A namespace may be protected by a token, see SetToken,
+// the requests to it must then send the token in the X-Geerpc-Token header.
+const DefaultNamespace = "default"
+
+var errInvalidToken = errors.New("rpc registry: invalid token")
+
+// Scope is the namespace and its token used by a client of the registry,
+// the zero value is the unprotected DefaultNamespace.
+type Scope struct {
+	Namespace string
+	Token     string
+}
+
+// Query returns the query selecting the namespace of s, add the other parameters to it.
+func (s Scope) Query() url.Values {
+	q := make(url.Values)
+	if s.Namespace != "" {
+		q.Set("namespace", s.Namespace)
+	}
+	return q
+}
+
+// SetHeader sets the token of s on h, if any.
+func (s Scope) SetHeader(h http.Header) {
+	if s.Token != "" {
+		h.Set("X-Geerpc-Token", s.Token)
+	}
+}
+
+// instanceKey identifies a server in the registry.
+type instanceKey struct {
+	namespace string
+	addr      string
+}
+
+func keyOf(s *ServerItem) instanceKey {
+	return instanceKey{namespace: s.Namespace, addr: s.Addr}
+}
+
+// namespaceOf returns the namespace named ns, empty means DefaultNamespace.
+func namespaceOf(ns string) (string, error) {
+	if ns == "" {
+		return DefaultNamespace, nil
+	}
+	for _, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", errors.New("rpc registry: invalid namespace " + ns)
+		}
+	}
+	return ns, nil
+}
+
+// SetToken protects namespace with token: every request to it, including
+// lists and watches, must send the token. Empty token removes the protection.
+// The nodes of a cluster check tokens on their own, set them on every node.
+func (r *GeeRegistry) SetToken(namespace, token string) {
+	namespace, _ = namespaceOf(namespace)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token == "" {
+		delete(r.tokens, namespace)
+		return
+	}
+	if r.tokens == nil {
+		r.tokens = make(map[string]string)
+	}
+	r.tokens[namespace] = token
+}
+
+// authorize checks token against the one of namespace, if any.
+func (r *GeeRegistry) authorize(namespace, token string) error {
+	r.mu.Lock()
+	want, ok := r.tokens[namespace]
+	r.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// namespace returns the namespace named ns if req is authorized to it,
+// or writes the error and returns false.
+func (r *GeeRegistry) namespace(w http.ResponseWriter, req *http.Request, ns string) (string, bool) {
+	ns, err := namespaceOf(ns)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if err := r.authorize(ns, req.Header.Get("X-Geerpc-Token")); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error()+" for namespace "+ns)
+		return "", false
+	}
+	return ns, true
+}
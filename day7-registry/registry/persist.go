@@ -0,0 +1,255 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PersistOption configures the on-disk state of a registry created by NewPersistent.
+type PersistOption struct {
+	Dir              string        // directory of the snapshot and the write-ahead log
+	SnapshotInterval time.Duration // time between two snapshots, the log is truncated on every snapshot
+	GracePeriod      time.Duration // time restored servers are kept without heartbeat, 0 means the registry timeout
+	Sync             bool          // fsync the log on every write, slower but survives a power loss
+}
+
+var DefaultPersistOption = &PersistOption{
+	SnapshotInterval: time.Minute,
+}
+
+const (
+	snapshotFile = "registry.snapshot"
+	walFile      = "registry.wal"
+
+	opRegister   = "register"
+	opDeregister = "deregister"
+)
+
+// walRecord is a line of the write-ahead log, Item is the whole server on register.
+// Records written before namespaces have no namespace, they are of DefaultNamespace.
+type walRecord struct {
+	Op        string      `json:"op"`
+	Namespace string      `json:"namespace,omitempty"`
+	Addr      string      `json:"addr"`
+	Item      *ServerItem `json:"item,omitempty"`
+}
+
+type snapshot struct {
+	Index   uint64       `json:"index"`
+	Servers []ServerItem `json:"servers"`
+}
+
+// store keeps the state of a registry on disk: every change is appended to
+// the write-ahead log, and the whole state is written to a snapshot on an
+// interval, which truncates the log.
+type store struct {
+	opt       PersistOption
+	wal       *os.File
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPersistent creates a registry like New, and restores the servers saved in opt.Dir.
+// Restored servers are not expired before opt.GracePeriod, so that they have
+// time to send their next heartbeat. Close the registry to write a last snapshot.
+func NewPersistent(timeout time.Duration, opt *PersistOption) (*GeeRegistry, error) {
+	if opt == nil || opt.Dir == "" {
+		return nil, errors.New("rpc registry: persist directory required")
+	}
+	o := *opt
+	if o.SnapshotInterval <= 0 {
+		o.SnapshotInterval = DefaultPersistOption.SnapshotInterval
+	}
+	if o.GracePeriod <= 0 {
+		o.GracePeriod = timeout
+	}
+	if err := os.MkdirAll(o.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := New(timeout)
+	if err := r.restore(o); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(o.Dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r.store = &store{opt: o, wal: wal, done: make(chan struct{}), stopped: make(chan struct{})}
+	r.mu.Lock()
+	r.startReaper() // for the restored servers
+	r.mu.Unlock()
+	go r.runSnapshot()
+	return r, nil
+}
+
+// restore loads the snapshot and replays the log written after it.
+func (r *GeeRegistry) restore(opt PersistOption) error {
+	data, err := os.ReadFile(filepath.Join(opt.Dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("rpc registry: invalid snapshot: %v", err)
+		}
+		r.index = snap.Index
+		for i := range snap.Servers {
+			s := snap.Servers[i]
+			s.Namespace, _ = namespaceOf(s.Namespace)
+			r.servers[keyOf(&s)] = &s
+		}
+	}
+
+	f, err := os.Open(filepath.Join(opt.Dir, walFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer func() { _ = f.Close() }()
+		br := bufio.NewReader(f)
+		for {
+			line, err := br.ReadBytes('\n')
+			if err == io.EOF {
+				// a line without '\n' was cut by a crash, ignore it
+				break
+			}
+			if err != nil {
+				return err
+			}
+			var rec walRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return fmt.Errorf("rpc registry: invalid log record: %v", err)
+			}
+			key := instanceKey{rec.Namespace, rec.Addr}
+			key.namespace, _ = namespaceOf(key.namespace)
+			switch {
+			case rec.Op == opRegister && rec.Item != nil:
+				s := *rec.Item
+				s.Namespace = key.namespace
+				r.servers[key] = &s
+			case rec.Op == opDeregister:
+				delete(r.servers, key)
+			}
+			r.index++
+		}
+	}
+
+	// expire restored servers at the end of the grace period, unless they renew
+	start := time.Now().Add(opt.GracePeriod - r.timeout)
+	for _, s := range r.servers {
+		s.start = start
+	}
+	if len(r.servers) > 0 {
+		log.Printf("rpc registry: restored %d servers from %s", len(r.servers), opt.Dir)
+	}
+	return nil
+}
+
+// appendLog appends a change of s to the write-ahead log. r.mu must be held.
+func (r *GeeRegistry) appendLog(op string, s *ServerItem) {
+	if r.store == nil || r.store.wal == nil {
+		return
+	}
+	rec := walRecord{Op: op, Namespace: s.Namespace, Addr: s.Addr}
+	if op == opRegister {
+		rec.Item = s
+	}
+	line, _ := json.Marshal(rec)
+	if _, err := r.store.wal.Write(append(line, '\n')); err != nil {
+		log.Println("rpc registry: write log error:", err)
+		return
+	}
+	if r.store.opt.Sync {
+		if err := r.store.wal.Sync(); err != nil {
+			log.Println("rpc registry: sync log error:", err)
+		}
+	}
+}
+
+func (r *GeeRegistry) runSnapshot() {
+	defer close(r.store.stopped)
+	t := time.NewTicker(r.store.opt.SnapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.store.done:
+			return
+		case <-t.C:
+			if err := r.Snapshot(); err != nil {
+				log.Println("rpc registry: snapshot error:", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes the servers of a persistent registry to disk and truncates the log.
+func (r *GeeRegistry) Snapshot() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store == nil || r.store.wal == nil {
+		return nil
+	}
+	snap := snapshot{Index: r.index, Servers: make([]ServerItem, 0, len(r.servers))}
+	for _, s := range r.servers {
+		snap.Servers = append(snap.Servers, *s)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, the old snapshot is valid until the rename
+	path := filepath.Join(r.store.opt.Dir, snapshotFile)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	// the snapshot covers the whole log, a crash before the truncation replays it again
+	if err := r.store.wal.Truncate(0); err != nil {
+		return err
+	}
+	_, err = r.store.wal.Seek(0, io.SeekStart)
+	return err
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// closeStore stops the snapshots after writing a last one.
+func (r *GeeRegistry) closeStore() error {
+	var err error
+	r.store.closeOnce.Do(func() {
+		close(r.store.done)
+		<-r.store.stopped
+		err = r.Snapshot()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if e := r.store.wal.Close(); err == nil {
+			err = e
+		}
+		r.store.wal = nil
+	})
+	return err
+}
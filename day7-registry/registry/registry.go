@@ -9,18 +9,88 @@ import (
 	"time"
 )
 
-//GeeRegistry is a simple register center, provide following functions.
+// GeeRegistry is a simple register center, provide following functions.
 // add a server and receive heartbeat to keep it alive.
 // returns all alive servers and delete dead servers sync simultaneously.
-//返回所有活着的服务器并同时删除死服务器同步。
+// 返回所有活着的服务器并同时删除死服务器同步。
 type GeeRegistry struct { //GeeRegistry结构体
 	timeout time.Duration //超时时间设置
 	mu      sync.Mutex
-	servers map[string]*ServerItem
+	servers map[instanceKey]*ServerItem
+	tokens  map[string]string // tokens of the protected namespaces, see SetToken
+	index   uint64            // revision of servers, increased on every change, see watch
+	changed chan struct{}     // closed and replaced on every change
+	store   *store            // nil unless created by NewPersistent
+	cluster *raftNode         // nil unless created by NewCluster
+
+	subscribers map[*Subscription]struct{}
+	reaper      chan struct{} // closed to stop the reaper, nil until it starts
 }
+
+// ServerItem is a server instance and its metadata, it's sent as json
+// by servers on registration and returned to discovery.
 type ServerItem struct {
-	Addr  string //服务端口+开始时间
-	start time.Time
+	Addr      string    `json:"addr"`                //服务端口+开始时间
+	Namespace string    `json:"namespace,omitempty"` // set by the registry, empty on registration means DefaultNamespace
+	Services  []string  `json:"services,omitempty"`  // names of the services served, empty means unknown, then it matches any service
+	Methods   []string  `json:"methods,omitempty"`   // optional, "Service.Method" served
+	Weight    int       `json:"weight,omitempty"`    // relative weight for load balancing, <= 0 means 1
+	Zone      string    `json:"zone,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	Version   string    `json:"version,omitempty"` // build version, eg. for canary routing
+	Tags      []string  `json:"tags,omitempty"`
+	StartTime time.Time `json:"start_time"` // set by the server, or the time of the first registration
+	start     time.Time // time of the last heartbeat
+}
+
+// setMetadata replaces the metadata of s with the one of item.
+func (s *ServerItem) setMetadata(item *ServerItem) {
+	s.Services, s.Methods = parseServices(append(append([]string(nil), item.Services...), item.Methods...))
+	s.Weight = item.Weight
+	s.Zone = item.Zone
+	s.Region = item.Region
+	s.Version = item.Version
+	s.Tags = item.Tags
+	if !item.StartTime.IsZero() {
+		s.StartTime = item.StartTime
+	}
+}
+
+// Serves reports whether the server serves service.
+func (s *ServerItem) Serves(service string) bool {
+	if service == "" || len(s.Services) == 0 {
+		return true
+	}
+	for _, name := range s.Services {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+// parseServices splits entries of "Service" or "Service.Method"
+// into sorted service names and methods.
+func parseServices(entries []string) (services, methods []string) {
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service := entry
+		if dot := strings.Index(entry, "."); dot >= 0 {
+			service = entry[:dot]
+			methods = append(methods, entry)
+		}
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+	sort.Strings(methods)
+	return
 }
 
 const (
@@ -28,68 +98,140 @@ const (
 	defaultTimeout = time.Minute * 5 //默认超时时间限制 ：5min
 )
 
-//New create a registry instance with timeout setting
+// New create a registry instance with timeout setting
 func New(timeout time.Duration) *GeeRegistry { //实例创建
 	return &GeeRegistry{
-		servers: make(map[string]*ServerItem), //创建服务实例映射
+		servers: make(map[instanceKey]*ServerItem), //创建服务实例映射
 		timeout: timeout,
+		changed: make(chan struct{}),
 	}
 }
 
 var DefaultGeeRegister = New(defaultTimeout) //默认超时时间设置为 5 min
-//为 GeeRegistry 实现添加服务实例和返回服务列表的方法。
-//putServer:添加服务实例，如果服务已经存在，则更新strat
-//aliveServers：返回可用的服务列表，如果存在超时的服务，则删除
-func (r *GeeRegistry) putServer(addr string) { //输入要用指针的形式
+// 为 GeeRegistry 实现添加服务实例和返回服务列表的方法。
+// putServer:添加服务实例，如果服务已经存在，则更新strat
+// aliveServers：返回可用的服务列表，如果存在超时的服务，则删除
+// update, if not nil, modifies the metadata of the server.
+// It returns true if the server is newly added.
+func (r *GeeRegistry) putServer(key instanceKey, update func(s *ServerItem)) (created bool) { //输入要用指针的形式
+	return r.putServerAt(key, time.Now(), update)
+}
+
+// putServerAt is like putServer, now is the time of the heartbeat.
+func (r *GeeRegistry) putServerAt(key instanceKey, now time.Time, update func(s *ServerItem)) (created bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	s := r.servers[addr]
+	s := r.servers[key]
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()} //赋值要用引用的形式
+		s = &ServerItem{Addr: key.addr, Namespace: key.namespace, StartTime: now, start: now} //赋值要用引用的形式
+		r.servers[key] = s
+		created = true
 	} else {
-		s.start = time.Now() //// if exists, update start time to keep alive
+		s.start = now //// if exists, update start time to keep alive
 	} //else要接在}之后
+	old := *s
+	if update != nil {
+		update(s)
+	}
+	switch {
+	case created:
+		r.record(EventRegistered, s)
+		r.startReaper()
+	case !sameMetadata(&old, s):
+		r.record(EventRenewed, s)
+	default:
+		r.publish(EventRenewed, s) // not a change of the servers
+	}
+	return
 }
-func (r *GeeRegistry) aliveServers() []string {
+
+// aliveItems returns copies of the alive servers of namespace serving service
+// sorted by address, empty service means all.
+func (r *GeeRegistry) aliveItems(namespace, service string) []ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
-	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
-		} else {
-			delete(r.servers, addr)
+	r.expire(time.Now())
+	var alive []ServerItem
+	for _, s := range r.servers {
+		if s.Namespace == namespace && s.Serves(service) {
+			alive = append(alive, *s)
 		}
 	}
-	sort.Strings(alive) //以首字母为标准进行升序排序
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr }) //以首字母为标准进行升序排序
+	return alive
+}
+
+// aliveServers returns the addresses of alive servers of namespace serving service, empty service means all.
+func (r *GeeRegistry) aliveServers(namespace, service string) []string {
+	var alive []string
+	for _, s := range r.aliveItems(namespace, service) {
+		alive = append(alive, s.Addr)
+	}
 	return alive
 }
 
-//为了实现上的简单，GeeRegistry 采用 HTTP 协议提供服务，且所有的有用信息都承载在 HTTP Header 中。
-//Get：返回所有可用的服务列表，通过自定义字段X-Geerpc-Servers承载
-//Post：添加服务实例或者发送心跳，通过自定义字段X-Geerpc-Servers承载
+// 为了实现上的简单，GeeRegistry 采用 HTTP 协议提供服务，且所有的有用信息都承载在 HTTP Header 中。
+// Get：返回所有可用的服务列表，通过自定义字段X-Geerpc-Servers承载
+// Post：添加服务实例或者发送心跳，通过自定义字段X-Geerpc-Servers承载
+// The header protocol is kept for compatibility, the json API under
+// /v1/instances is preferred, see apiPath. Both select a namespace with ?namespace=,
+// see DefaultNamespace. The servers of every namespace are listed at /status.
 // Runs at /_geerpc_/registry
 func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) { //写成serversHTTP
+	if r.cluster != nil {
+		if i := strings.Index(req.URL.EscapedPath(), raftPath+"/"); i >= 0 {
+			r.cluster.ServeHTTP(w, req, req.URL.EscapedPath()[i+len(raftPath):])
+			return
+		}
+		// writes go to the leader
+		if req.Method != "GET" && !r.cluster.redirect(w, req) {
+			return
+		}
+	}
+	if i := strings.Index(req.URL.EscapedPath(), apiPath); i >= 0 {
+		r.serveAPI(w, req, req.URL.EscapedPath()[i+len(apiPath):])
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, statusPath) && req.Method == "GET" {
+		r.serveStatus(w)
+		return
+	}
+	namespace, ok := r.namespace(w, req, req.URL.Query().Get("namespace"))
+	if !ok {
+		return
+	}
 	switch req.Method {
 	case "GET": //返回所有可用的服务列表，通过自定义字段 X-Geerpc-Servers 承载。
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ","))
+		// ?service=Foo only returns the servers serving Foo
+		service := req.URL.Query().Get("service")
+		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(namespace, service), ","))
 	case "POST": //添加服务实例或发送心跳，通过自定义字段 X-Geerpc-Server 承载
 		addr := req.Header.Get("X-Geerpc-Server")
 		if addr == "" {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		r.putServer(addr) //添加服务实例，如果服务已经存在，则更新 start。
+		// optional X-Geerpc-Services: Foo.Sum,Foo.Sleep,Bar
+		var services []string
+		if h := req.Header.Get("X-Geerpc-Services"); h != "" {
+			services = strings.Split(h, ",")
+		}
+		if err := r.renew(instanceKey{namespace, addr}, services); err != nil { //添加服务实例，如果服务已经存在，则更新 start。
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
 // HandleHTTP registers an HTTP handler for GeeRegistry messages on registryPath
-//HandleHTTP 在 registryPath 上为 GeeRegistry 消息注册一个 HTTP 处理程序
+// HandleHTTP 在 registryPath 上为 GeeRegistry 消息注册一个 HTTP 处理程序
 func (r *GeeRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
+	http.Handle(registryPath+"/v1/", r)
+	http.Handle(registryPath+statusPath, r)
+	http.Handle(registryPath+raftPath+"/", r)
 	log.Println("rpc registry path:", registryPath)
 }
 
@@ -97,35 +239,16 @@ func HandleHTTP() {
 	DefaultGeeRegister.HandleHTTP(defaultPath)
 }
 
-//另外，提供 Heartbeat 方法，便于服务启动时定时向注册中心发送心跳，
-//默认周期比注册中心设置的过期时间少 1 min。
-// Heartbeat send a heartbeat message every once in a while
-// it's a helper function for a server to register or send heartbeat
-//helper 辅助函数
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
-		// make sure there is enough time to send heart beat
-		// before it's removed from registry
-		duration = defaultTimeout - time.Duration(1)*time.Minute
-	}
-	var err error
-	err = sendHeartbeat(registry, addr)
-	go func() {
-		t := time.NewTicker(duration)
-		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
-		}
-	}()
-}
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-Geerpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server：heart beaterr", err)
-		return err
+// Close stops the reaper and the node of a registry created by NewCluster, and writes
+// the last snapshot of a registry created by NewPersistent.
+// It does nothing for a registry created by New.
+func (r *GeeRegistry) Close() error {
+	r.stopReaper()
+	if r.cluster != nil {
+		r.cluster.stop()
+	}
+	if r.store != nil {
+		return r.closeStore()
 	}
 	return nil
 }
@@ -0,0 +1,383 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func heartbeat(r *GeeRegistry, addr, services string) {
+	req := httptest.NewRequest("POST", defaultPath, nil)
+	req.Header.Set("X-Geerpc-Server", addr)
+	if services != "" {
+		req.Header.Set("X-Geerpc-Services", services)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func list(r *GeeRegistry, query string) string {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", defaultPath+query, nil))
+	return w.Header().Get("X-Geerpc-Servers")
+}
+
+func TestGeeRegistry_services(t *testing.T) {
+	r := New(time.Minute)
+	heartbeat(r, "tcp@foo:1", "Foo.Sum,Foo.Sleep")
+	heartbeat(r, "tcp@bar:1", "Bar")
+	heartbeat(r, "tcp@old:1", "")
+
+	_assert(list(r, "") == "tcp@bar:1,tcp@foo:1,tcp@old:1", "expect all servers, got %s", list(r, ""))
+	_assert(list(r, "?service=Foo") == "tcp@foo:1,tcp@old:1", "expect Foo servers, got %s", list(r, "?service=Foo"))
+	_assert(list(r, "?service=Bar") == "tcp@bar:1,tcp@old:1", "expect Bar servers, got %s", list(r, "?service=Bar"))
+
+	s := r.servers[instanceKey{DefaultNamespace, "tcp@foo:1"}]
+	_assert(len(s.Services) == 1 && s.Services[0] == "Foo", "wrong services %v", s.Services)
+	_assert(len(s.Methods) == 2 && s.Methods[0] == "Foo.Sleep", "wrong methods %v", s.Methods)
+
+	// a heartbeat without services keeps the published ones
+	heartbeat(r, "tcp@foo:1", "")
+	_assert(list(r, "?service=Bar") == "tcp@bar:1,tcp@old:1", "expect Foo servers to stay out of Bar")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", defaultPath, nil))
+	_assert(w.Code == http.StatusBadRequest, "expect an error without server address")
+}
+
+func TestGeeRegistry_metadata(t *testing.T) {
+	r := New(time.Minute)
+	item := &ServerItem{
+		Addr:     "tcp@foo:1",
+		Services: []string{"Foo.Sum"},
+		Weight:   3,
+		Zone:     "zone-a",
+		Version:  "v1.2.0",
+		Tags:     []string{"canary"},
+	}
+	w := api(r, "POST", "", item)
+	_assert(w.Code == http.StatusCreated, "expect to register, got %d", w.Code)
+
+	w = api(r, "GET", "?service=Foo", nil)
+	var items []ServerItem
+	_ = json.NewDecoder(w.Body).Decode(&items)
+	_assert(len(items) == 1 && list(r, "?service=Foo") == "tcp@foo:1", "expect 1 server, got %v", items)
+	got := items[0]
+	_assert(got.Weight == 3 && got.Zone == "zone-a" && got.Version == "v1.2.0" && got.Tags[0] == "canary",
+		"wrong metadata %+v", got)
+	_assert(got.Services[0] == "Foo" && got.Methods[0] == "Foo.Sum", "wrong services %+v", got)
+	_assert(!got.StartTime.IsZero(), "expect start time to be set")
+
+	// header heartbeats keep the metadata
+	heartbeat(r, "tcp@foo:1", "")
+	_assert(r.servers[instanceKey{DefaultNamespace, "tcp@foo:1"}].Weight == 3, "expect metadata to be kept")
+}
+
+func api(r *GeeRegistry, method, path string, item *ServerItem) *httptest.ResponseRecorder {
+	var body io.Reader
+	if item != nil {
+		b, _ := json.Marshal(item)
+		body = bytes.NewReader(b)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, defaultPath+apiPath+path, body))
+	return w
+}
+
+func errorOf(w *httptest.ResponseRecorder) string {
+	var e apiError
+	_ = json.NewDecoder(w.Body).Decode(&e)
+	return e.Error
+}
+
+func TestGeeRegistry_api(t *testing.T) {
+	r := New(time.Minute)
+	path := "/" + url.PathEscape("unix@/tmp/foo.sock")
+
+	w := api(r, "GET", "", nil)
+	_assert(w.Code == http.StatusOK && strings.TrimSpace(w.Body.String()) == "[]", "expect an empty list, got %s", w.Body)
+	w = api(r, "GET", path, nil)
+	_assert(w.Code == http.StatusNotFound && errorOf(w) != "", "expect not found, got %d", w.Code)
+
+	w = api(r, "PUT", path, &ServerItem{Weight: 2})
+	_assert(w.Code == http.StatusCreated, "expect to register, got %d", w.Code)
+	w = api(r, "PUT", path, &ServerItem{Weight: 3})
+	_assert(w.Code == http.StatusOK, "expect to renew, got %d", w.Code)
+	w = api(r, "GET", path, nil)
+	var item ServerItem
+	_ = json.NewDecoder(w.Body).Decode(&item)
+	_assert(w.Code == http.StatusOK && item.Addr == "unix@/tmp/foo.sock" && item.Weight == 3, "wrong instance %+v", item)
+
+	w = api(r, "PUT", path, &ServerItem{Addr: "tcp@bar:1"})
+	_assert(w.Code == http.StatusBadRequest && errorOf(w) != "", "expect address mismatch, got %d", w.Code)
+	w = api(r, "POST", "", &ServerItem{})
+	_assert(w.Code == http.StatusBadRequest && errorOf(w) != "", "expect missing address, got %d", w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", defaultPath+apiPath, strings.NewReader("{")))
+	_assert(w.Code == http.StatusBadRequest, "expect invalid body, got %d", w.Code)
+	w = api(r, "PATCH", path, nil)
+	_assert(w.Code == http.StatusMethodNotAllowed, "expect method not allowed, got %d", w.Code)
+
+	w = api(r, "DELETE", path, nil)
+	_assert(w.Code == http.StatusNoContent, "expect to deregister, got %d", w.Code)
+	w = api(r, "DELETE", path, nil)
+	_assert(w.Code == http.StatusNotFound, "expect not found, got %d", w.Code)
+	_assert(list(r, "") == "", "expect no server")
+}
+
+func TestGeeRegistry_namespaces(t *testing.T) {
+	r := New(time.Minute)
+	heartbeat(r, "tcp@foo:1", "Foo")
+	req := httptest.NewRequest("POST", defaultPath+"?namespace=staging", nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@foo:2")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	_assert(list(r, "") == "tcp@foo:1", "expect the default namespace only, got %s", list(r, ""))
+	_assert(list(r, "?namespace=staging") == "tcp@foo:2", "expect the staging namespace only")
+	w := api(r, "POST", "?namespace=staging", &ServerItem{Addr: "tcp@foo:3", Namespace: "prod"})
+	_assert(w.Code == http.StatusBadRequest, "expect namespace mismatch, got %d", w.Code)
+	w = api(r, "GET", "?namespace=a/b", nil)
+	_assert(w.Code == http.StatusBadRequest, "expect invalid namespace, got %d", w.Code)
+
+	// a protected namespace needs its token
+	r.SetToken("prod", "secret")
+	w = api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1", Namespace: "prod"})
+	_assert(w.Code == http.StatusUnauthorized && errorOf(w) != "", "expect unauthorized, got %d", w.Code)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	h := NewHeartbeater([]string{ts.URL}, &ServerItem{Addr: "tcp@foo:1", Namespace: "prod"}, &HeartbeatOption{Token: "secret"})
+	h.Start(context.Background())
+	_assert(h.Status()[0].Registered && h.Status()[0].Registrations == 1, "expect to register with the token, got %+v", h.Status()[0])
+	w = api(r, "GET", "?namespace=prod", nil)
+	_assert(w.Code == http.StatusUnauthorized, "expect to list with the token only, got %d", w.Code)
+	req = httptest.NewRequest("GET", defaultPath+apiPath+"?namespace=prod", nil)
+	req.Header.Set("X-Geerpc-Token", "secret")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var items []ServerItem
+	_ = json.NewDecoder(w.Body).Decode(&items)
+	_assert(len(items) == 1 && items[0].Namespace == "prod", "expect the server of prod, got %+v", items)
+	_assert(list(r, "") == "tcp@foo:1" && r.servers[instanceKey{DefaultNamespace, "tcp@foo:1"}].Services != nil,
+		"expect the same address in the default namespace to be untouched")
+
+	// the status page lists every namespace, without the servers of protected ones
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", defaultPath+statusPath, nil))
+	page := w.Body.String()
+	_assert(strings.Contains(page, "Namespace default (1)") && strings.Contains(page, "Namespace staging (1)") &&
+		strings.Contains(page, "Namespace prod (1, protected)") && strings.Contains(page, "tcp@foo:2"), "wrong status page %s", page)
+
+	_assert(h.Stop() == nil, "expect to deregister with the token")
+	_assert(len(r.aliveItems("prod", "")) == 0 && list(r, "") == "tcp@foo:1", "expect prod only to be deregistered")
+}
+
+func TestHeartbeater_Stop(t *testing.T) {
+	r := New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	hb := Heartbeat(ts.URL, "tcp@foo:1", time.Millisecond*10, "Foo")
+	_assert(list(r, "") == "tcp@foo:1", "expect the server to be registered")
+	time.Sleep(time.Millisecond * 30)
+
+	_assert(hb.Stop() == nil, "expect to deregister")
+	_assert(list(r, "") == "", "expect the server to be deregistered immediately")
+	time.Sleep(time.Millisecond * 30)
+	_assert(list(r, "") == "", "expect no heartbeat after Stop")
+	_assert(hb.Stop() == nil, "expect Stop to be idempotent")
+}
+
+// flakyRegistry serves r, or fails with 503 if r is nil
+type flakyRegistry struct {
+	mu sync.Mutex
+	r  *GeeRegistry
+}
+
+func (f *flakyRegistry) set(r *GeeRegistry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.r = r
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	r := f.r
+	f.mu.Unlock()
+	if r == nil {
+		writeError(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	r.ServeHTTP(w, req)
+}
+
+func waitFor(cond func() bool, msg string) {
+	for i := 0; i < 200 && !cond(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(cond(), msg)
+}
+
+func TestHeartbeater(t *testing.T) {
+	flaky := &flakyRegistry{}
+	ts1 := httptest.NewServer(flaky)
+	defer ts1.Close()
+	r2 := New(time.Minute)
+	ts2 := httptest.NewServer(r2)
+	defer ts2.Close()
+
+	h := NewHeartbeater([]string{ts1.URL, ts2.URL}, &ServerItem{Addr: "tcp@foo:1"}, &HeartbeatOption{
+		Interval:   time.Millisecond * 50,
+		MinBackoff: time.Millisecond * 10,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	h.Start(ctx)
+	status := h.Status()
+	_assert(!status[0].Registered && status[0].Failures == 1 && strings.Contains(status[0].LastError.Error(), "unavailable"),
+		"expect the first registry to fail, got %+v", status[0])
+	_assert(status[1].Registered && list(r2, "") == "tcp@foo:1", "expect the second registry not to be delayed")
+
+	// retried until the registry is back
+	r1 := New(time.Minute)
+	flaky.set(r1)
+	waitFor(func() bool { return h.Status()[0].Registered }, "expect to retry until registered")
+	_assert(list(r1, "") == "tcp@foo:1" && h.Status()[0].Failures == 0, "expect to be registered")
+
+	// registered again after the registry restarts
+	r1 = New(time.Minute)
+	flaky.set(r1)
+	waitFor(func() bool { return h.Status()[0].Registrations == 2 }, "expect to register again")
+	_assert(list(r1, "") == "tcp@foo:1", "expect to be registered to the restarted registry")
+
+	// cancelling ctx stops the heartbeats without deregistration
+	cancel()
+	h.running.Wait()
+	last := h.Status()[1].LastHeartbeat
+	time.Sleep(time.Millisecond * 100)
+	_assert(h.Status()[1].LastHeartbeat.Equal(last), "expect no heartbeat after cancel")
+	_assert(list(r2, "") == "tcp@foo:1", "expect not to deregister on cancel")
+
+	_assert(h.Stop() == nil, "expect to deregister")
+	_assert(list(r1, "") == "" && list(r2, "") == "", "expect to be deregistered from every registry")
+}
+
+func TestGeeRegistry_watch(t *testing.T) {
+	r := New(time.Minute)
+	watch := func(query string) (*httptest.ResponseRecorder, time.Duration) {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", defaultPath+apiPath+query, nil))
+		return w, time.Since(start)
+	}
+	w, _ := watch("")
+	_assert(w.Header().Get("X-Geerpc-Index") == "0", "expect index 0, got %s", w.Header().Get("X-Geerpc-Index"))
+
+	// the watch returns once a server registers
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	}()
+	w, d := watch("?index=0&wait=5s")
+	_assert(d < time.Second && w.Header().Get("X-Geerpc-Index") == "1", "expect the watch to return on change")
+	_assert(strings.Contains(w.Body.String(), "tcp@foo:1"), "expect the new server, got %s", w.Body)
+
+	// a renewal is not a change
+	api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	w, d = watch("?index=1&wait=100ms")
+	_assert(d >= time.Millisecond*100 && w.Header().Get("X-Geerpc-Index") == "1", "expect the watch to wait")
+
+	// a stale or restarted index returns at once
+	w, d = watch("?index=0&wait=5s")
+	_assert(d < time.Second, "expect stale index to return at once")
+	w, d = watch("?index=7&wait=5s")
+	_assert(d < time.Second && w.Header().Get("X-Geerpc-Index") == "1", "expect index ahead to return at once")
+
+	w, _ = watch("?index=x")
+	_assert(w.Code == http.StatusBadRequest, "expect invalid index, got %d", w.Code)
+
+	// expiry is a change
+	r = New(time.Millisecond * 100)
+	api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	w, d = watch("?index=1&wait=5s")
+	_assert(d < time.Second && strings.TrimSpace(w.Body.String()) == "[]", "expect the server to expire, got %s", w.Body)
+}
+
+func TestNewPersistent(t *testing.T) {
+	dir := t.TempDir()
+	opt := &PersistOption{Dir: dir, SnapshotInterval: time.Hour}
+	r, err := NewPersistent(time.Minute, opt)
+	_assert(err == nil, "failed to create registry: %v", err)
+	api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1", Weight: 2})
+	api(r, "POST", "", &ServerItem{Addr: "tcp@bar:1"})
+	_assert(r.Snapshot() == nil, "failed to snapshot")
+	// changes after the snapshot are in the log only
+	api(r, "POST", "", &ServerItem{Addr: "tcp@baz:1"})
+	api(r, "POST", "", &ServerItem{Addr: "tcp@bar:1", Namespace: "staging"})
+	api(r, "DELETE", "/tcp@bar:1", nil)
+
+	// restart without Close, as after a crash
+	r2, err := NewPersistent(time.Minute, opt)
+	_assert(err == nil, "failed to restore registry: %v", err)
+	_assert(list(r2, "") == "tcp@baz:1,tcp@foo:1", "expect servers to be restored, got %s", list(r2, ""))
+	item, _ := r2.getServer(instanceKey{DefaultNamespace, "tcp@foo:1"})
+	_assert(item.Weight == 2, "expect metadata to be restored")
+	_assert(list(r2, "?namespace=staging") == "tcp@bar:1", "expect namespaces to be restored")
+	_assert(r2.index >= r.index, "expect the revision not to go back, %d < %d", r2.index, r.index)
+	_ = r.Close()
+	_assert(r2.Close() == nil, "failed to close registry")
+
+	// restored servers expire after the grace period unless they renew
+	r3, _ := NewPersistent(time.Minute, &PersistOption{Dir: dir, GracePeriod: time.Millisecond * 100})
+	defer func() { _ = r3.Close() }()
+	_assert(list(r3, "") == "tcp@baz:1,tcp@foo:1", "expect servers to be restored from the last snapshot")
+	api(r3, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	time.Sleep(time.Millisecond * 150)
+	_assert(list(r3, "") == "tcp@foo:1", "expect only the renewed server to be kept, got %s", list(r3, ""))
+}
+
+func TestGeeRegistry_events(t *testing.T) {
+	r := New(time.Millisecond * 100)
+	defer func() { _ = r.Close() }()
+	sub := r.Subscribe(16)
+	full := r.Subscribe(0)
+	next := func() Event {
+		select {
+		case e := <-sub.C:
+			return e
+		case <-time.After(time.Second):
+			panic("expect an event")
+		}
+	}
+
+	api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	api(r, "POST", "", &ServerItem{Addr: "tcp@foo:1"})
+	api(r, "POST", "", &ServerItem{Addr: "tcp@bar:1"})
+	api(r, "DELETE", "/tcp@bar:1", nil)
+	for _, want := range []EventType{EventRegistered, EventRenewed, EventRegistered, EventDeregistered} {
+		e := next()
+		_assert(e.Type == want, "expect %s, got %s of %s", want, e.Type, e.Item.Addr)
+	}
+
+	// the reaper expires foo without anyone listing the servers
+	e := next()
+	_assert(e.Type == EventExpired && e.Item.Addr == "tcp@foo:1", "expect foo to expire, got %+v", e)
+	r.mu.Lock()
+	_assert(len(r.servers) == 0, "expect foo to be removed")
+	r.mu.Unlock()
+
+	_assert(full.Dropped() == 5, "expect events to be dropped for a full subscriber, got %d", full.Dropped())
+	sub.Close()
+	_, ok := <-sub.C
+	_assert(!ok, "expect C to be closed")
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Registry serves a GeeRegistry as a geerpc service, so that a registry
+// can be reached with XDial over tcp, unix or http like any other service,
+// and a geerpc.Server can be a registry too:
+//
+//	server.Register(registry.NewService(registry.New(0)))
+//
+// The service methods are Registry.Register, Registry.Renew,
+// Registry.Deregister, Registry.List and Registry.Watch.
+// The arguments select a namespace, and carry its token if it's protected.
+//
+// Unlike the http api, writes (Register, Renew and Deregister) are not
+// redirected by the followers of a cluster: they fail with an error naming
+// the address of the leader, or with "no cluster leader" during an election.
+// Serve the service of every node and retry on another one, or send writes
+// over http, eg. with Heartbeat.
+type Registry struct {
+	r *GeeRegistry
+}
+
+// NewService creates the geerpc service of r.
+func NewService(r *GeeRegistry) *Registry {
+	return &Registry{r: r}
+}
+
+// RegisterArgs are the arguments of Registry.Register, the namespace is the one of Item.
+type RegisterArgs struct {
+	Item  ServerItem
+	Token string
+}
+
+// RegisterReply is the reply of Registry.Register.
+type RegisterReply struct {
+	Created bool       // the server is newly added
+	Item    ServerItem // the server as registered
+}
+
+// RenewArgs are the arguments of Registry.Renew.
+type RenewArgs struct {
+	Namespace string
+	Addr      string
+	Services  []string // optional, replace the services of Addr, see Heartbeat
+	Token     string
+}
+
+// DeregisterArgs are the arguments of Registry.Deregister.
+type DeregisterArgs struct {
+	Namespace string
+	Addr      string
+	Token     string
+}
+
+// ListArgs are the arguments of Registry.List and Registry.Watch.
+type ListArgs struct {
+	Namespace string
+	Service   string        // only list the servers serving Service, empty means all
+	Index     uint64        // Watch returns once the revision of the registry differs from Index
+	Wait      time.Duration // max time Watch waits for a change, 0 means 30s
+	Token     string
+}
+
+// ListReply is the reply of Registry.List and Registry.Watch.
+type ListReply struct {
+	Index   uint64 // revision of the registry, watch from it
+	Servers []ServerItem
+}
+
+var errMissingAddr = errors.New("rpc registry: missing instance address")
+
+// namespace returns the namespace named ns if token is authorized to it.
+func (s *Registry) namespace(ns, token string) (string, error) {
+	ns, err := namespaceOf(ns)
+	if err != nil {
+		return "", err
+	}
+	if err := s.r.authorize(ns, token); err != nil {
+		return "", errors.New(err.Error() + " for namespace " + ns)
+	}
+	return ns, nil
+}
+
+// Register registers args.Item with its metadata, or renews it.
+func (s *Registry) Register(args RegisterArgs, reply *RegisterReply) error {
+	item := args.Item
+	if item.Addr == "" {
+		return errMissingAddr
+	}
+	var err error
+	if item.Namespace, err = s.namespace(item.Namespace, args.Token); err != nil {
+		return err
+	}
+	created, err := s.r.register(&item)
+	if err != nil {
+		return err
+	}
+	reply.Created = created
+	reply.Item, _ = s.r.getServer(keyOf(&item))
+	return nil
+}
+
+// Renew renews args.Addr, or registers it without metadata.
+func (s *Registry) Renew(args RenewArgs, reply *bool) error {
+	if args.Addr == "" {
+		return errMissingAddr
+	}
+	ns, err := s.namespace(args.Namespace, args.Token)
+	if err != nil {
+		return err
+	}
+	if err := s.r.renew(instanceKey{ns, args.Addr}, args.Services); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Deregister removes the server at args.Addr.
+func (s *Registry) Deregister(args DeregisterArgs, reply *bool) error {
+	ns, err := s.namespace(args.Namespace, args.Token)
+	if err != nil {
+		return err
+	}
+	ok, err := s.r.deregister(instanceKey{ns, args.Addr})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("rpc registry: instance " + args.Addr + " not found")
+	}
+	*reply = true
+	return nil
+}
+
+// List returns the alive servers.
+func (s *Registry) List(args ListArgs, reply *ListReply) error {
+	ns, err := s.namespace(args.Namespace, args.Token)
+	if err != nil {
+		return err
+	}
+	reply.Servers, reply.Index = s.r.items(ns, args.Service)
+	return nil
+}
+
+// Watch returns the alive servers once the revision of the registry differs
+// from args.Index, or after args.Wait with the unchanged list.
+// It returns early once ctx is done, ie. when the connection is closed, the
+// server shuts down or the request handle times out, so a watch doesn't hold
+// the server for up to 5 min. Use a HandleTimeout longer than args.Wait.
+func (s *Registry) Watch(ctx context.Context, args ListArgs, reply *ListReply) error {
+	if _, err := s.namespace(args.Namespace, args.Token); err != nil {
+		return err
+	}
+	s.r.wait(ctx, args.Index, args.Wait)
+	return s.List(args, reply)
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusPath is the status page of the registry, relative to the registry path.
+const statusPath = "/status"
+
+const statusText = `<html>
+	<body>
+	<title>GeeRegistry</title>
+	{{range .}}
+	<hr>
+	Namespace {{.Name}} ({{len .Servers}}{{if .Protected}}, protected{{end}})
+	<hr>
+		{{if .Protected}}
+		servers of protected namespaces are not listed
+		{{else}}
+		<table>
+		<th align=center>Server</th><th align=center>Services</th><th align=center>Zone</th><th align=center>Version</th><th align=center>Last heartbeat</th>
+		{{range .Servers}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=left>{{join .Services}}</td>
+			<td align=center>{{.Zone}}</td>
+			<td align=center>{{.Version}}</td>
+			<td align=center>{{since .}}</td>
+			</tr>
+		{{end}}
+		</table>
+		{{end}}
+	{{end}}
+	</body>
+	</html>`
+
+var status = template.Must(template.New("registry status").Funcs(template.FuncMap{
+	"join":  func(s []string) string { return strings.Join(s, ",") },
+	"since": func(s ServerItem) string { return time.Since(s.start).Truncate(time.Second).String() + " ago" },
+}).Parse(statusText))
+
+type statusNamespace struct {
+	Name      string
+	Protected bool
+	Servers   []ServerItem
+}
+
+// namespaces returns the alive servers of every namespace sorted by name.
+func (r *GeeRegistry) namespaces() []statusNamespace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+	byName := make(map[string]*statusNamespace)
+	for ns := range r.tokens {
+		byName[ns] = &statusNamespace{Name: ns, Protected: true}
+	}
+	for _, s := range r.servers {
+		ns := byName[s.Namespace]
+		if ns == nil {
+			ns = &statusNamespace{Name: s.Namespace}
+			byName[s.Namespace] = ns
+		}
+		ns.Servers = append(ns.Servers, *s)
+	}
+	namespaces := make([]statusNamespace, 0, len(byName))
+	for _, ns := range byName {
+		sort.Slice(ns.Servers, func(i, j int) bool { return ns.Servers[i].Addr < ns.Servers[j].Addr })
+		namespaces = append(namespaces, *ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces
+}
+
+// Runs at /_geerpc_/registry/status
+func (r *GeeRegistry) serveStatus(w http.ResponseWriter) {
+	if err := status.Execute(w, r.namespaces()); err != nil {
+		_, _ = fmt.Fprintln(w, "rpc registry: error executing template:", err.Error())
+	}
+}
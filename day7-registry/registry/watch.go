@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// A watch is a blocking list of the json API:
+//
+//	GET /v1/instances?index=N[&wait=30s][&service=Foo][&namespace=staging]
+//
+// it returns as soon as the revision of the registry differs from N, or after
+// wait with the unchanged list. The revision is returned in the X-Geerpc-Index
+// header of every list, a client watches with the index of the last response.
+const (
+	defaultWatchWait = time.Second * 30
+	maxWatchWait     = time.Minute * 5
+)
+
+// bump increases the revision and wakes up the watches. r.mu must be held.
+func (r *GeeRegistry) bump() {
+	r.index++
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// sameMetadata reports whether a and b are the same, heartbeat time apart.
+func sameMetadata(a, b *ServerItem) bool {
+	x, y := *a, *b
+	x.start, y.start = time.Time{}, time.Time{}
+	return reflect.DeepEqual(x, y)
+}
+
+// revision returns the revision of r, a channel closed on the next change,
+// and the time the next server expires, zero if none.
+func (r *GeeRegistry) revision() (index uint64, changed <-chan struct{}, expiry time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timeout != 0 {
+		for _, s := range r.servers {
+			if t := s.start.Add(r.timeout); expiry.IsZero() || t.Before(expiry) {
+				expiry = t
+			}
+		}
+	}
+	return r.index, r.changed, expiry
+}
+
+// items returns the alive servers of namespace serving service and the revision they are at.
+// The revision is the one of the whole registry, a change in another namespace
+// wakes up the watches too, with the same list.
+func (r *GeeRegistry) items(namespace, service string) ([]ServerItem, uint64) {
+	// read the index first, so the list is at least as new as it
+	index, _, _ := r.revision()
+	items := r.aliveItems(namespace, service)
+	if items == nil {
+		items = []ServerItem{}
+	}
+	return items, index
+}
+
+// list writes the alive servers of namespace serving service and the revision they are at.
+func (r *GeeRegistry) list(w http.ResponseWriter, namespace, service string) {
+	items, index := r.items(namespace, service)
+	w.Header().Set("X-Geerpc-Index", strconv.FormatUint(index, 10))
+	writeJSON(w, http.StatusOK, items)
+}
+
+// wait waits up to wait for the revision of r to differ from index,
+// and returns false if ctx is done first.
+func (r *GeeRegistry) wait(ctx context.Context, index uint64, wait time.Duration) bool {
+	if wait <= 0 {
+		wait = defaultWatchWait
+	}
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		// expired servers are removed by the reaper, which is a change too
+		current, changed, _ := r.revision()
+		// an index ahead of the registry means it restarted, return at once
+		if current != index {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		case <-timeout.C:
+			return true
+		}
+	}
+}
+
+func (r *GeeRegistry) serveWatch(w http.ResponseWriter, req *http.Request, namespace string) {
+	q := req.URL.Query()
+	index, err := strconv.ParseUint(q.Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid index "+q.Get("index"))
+		return
+	}
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid wait "+v)
+			return
+		}
+	}
+	if r.wait(req.Context(), index, wait) {
+		r.list(w, namespace, q.Get("service"))
+	}
+}
@@ -5,6 +5,8 @@
 package geerpc
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,18 +16,30 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MagicNumber = 0x3bef5c
 
+// Option is sent first on a connection, see Server.ServeConn.
+//
+// HandleTimeout bounds the time to reply to a request, 0 means no limit.
+// A request timing out is replied with an error, but it stays in flight
+// until its method returns: the context of the methods taking one is
+// cancelled, the other methods run to the end, and the connection and its
+// codec are kept open until then, even once closed by the client.
 type Option struct {
 	MagicNumber    int           // MagicNumber marks this's a geerpc request
 	CodecType      codec.Type    // client may choose different Codec to encode body
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	Metrics        *ClientMetrics `json:"-"` // metrics of the calls of the client, nil means DefaultClientMetrics
+	Tracer         *Tracer        `json:"-"` // tracer of the calls of the client, nil means DefaultTracer
 }
 
 var DefaultOption = &Option{
@@ -37,6 +51,18 @@ var DefaultOption = &Option{
 // Server represents an RPC Server.
 type Server struct {
 	serviceMap sync.Map
+	inflight   int64 // requests being handled, accessed atomically
+
+	mu         sync.Mutex // protect following
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[io.Closer]*serverConn
+	lastConnID uint64
+	onShutdown []func()
+	ctx        context.Context // parent of the contexts of the requests, done on Shutdown
+	cancel     context.CancelFunc
+	tracer     *Tracer
+	debugOpt   *DebugOption
 }
 
 // NewServer returns a new Server.
@@ -51,8 +77,15 @@ var DefaultServer = NewServer()
 // ServeConn blocks, serving the connection until the client hangs up.
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
-	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	sc := server.trackConn(conn)
+	if sc == nil {
+		return
+	}
+	defer server.untrackConn(conn)
+	conn = &countingConn{ReadWriteCloser: conn, conn: sc}
+	br := bufio.NewReader(conn)
+	opt, err := readOption(br)
+	if err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
@@ -65,29 +98,82 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	sc.setCodec(opt.CodecType)
+	server.serveCodec(f(&bufferedConn{r: br, ReadWriteCloser: conn, conn: sc}), opt, sc)
+}
+
+// readOption reads the option sent first on a connection, a single line of
+// json. Exactly that line is read from br, the bytes of the first request,
+// which the client may send along, are left in br for the codec.
+func readOption(br *bufio.Reader) (*Option, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var opt Option
+	if err := json.Unmarshal(line, &opt); err != nil {
+		return nil, err
+	}
+	return &opt, nil
+}
+
+// bufferedConn reads through r, which may hold bytes read ahead from the
+// underlying conn, and writes and closes the underlying conn.
+// The bytes read by the codec are counted in conn.decoded, it's an
+// io.ByteReader so that codecs like gob don't read ahead on their own.
+type bufferedConn struct {
+	r *bufio.Reader
+	io.ReadWriteCloser
+	conn *serverConn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.conn.decoded += uint64(n)
+	return n, err
+}
+
+func (c *bufferedConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.conn.decoded++
+	}
+	return b, err
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, sc *serverConn) {
 	sending := new(sync.Mutex) // make sure to send a complete response
 	wg := new(sync.WaitGroup)  // wait until all request are handled
+	// the requests are cancelled once the connection is closed
+	ctx, cancel := context.WithCancel(server.context())
 	for {
+		decoded := sc.decoded
 		req, err := server.readRequest(cc)
 		if err != nil {
 			if req == nil {
 				break // it's not possible to recover, so close the connection
 			}
 			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			server.sendResponse(cc, req.h, invalidRequest, sending, sc)
+			continue
+		}
+		if server.shuttingDown() {
+			req.h.Error = ErrServerShutdown.Error()
+			server.sendResponse(cc, req.h, invalidRequest, sending, sc)
 			continue
 		}
+		req.bytesIn = sc.decoded - decoded
+		atomic.AddInt64(&server.inflight, 1)
+		req.conn = sc
+		sc.begin(req)
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		go server.handleRequest(ctx, cc, req, sending, wg, opt.HandleTimeout)
 	}
-	wg.Wait()
+	cancel()
+	wg.Wait() // methods without a context are not interrupted, see Option.HandleTimeout
 	_ = cc.Close()
 }
 
@@ -97,6 +183,8 @@ type request struct {
 	argv, replyv reflect.Value // argv and replyv of request
 	mtype        *methodType
 	svc          *service
+	conn         *serverConn // nil if the request isn't tracked
+	bytesIn      uint64      // size of the request read by the codec
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -155,52 +243,103 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	return req, nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
+// sendResponse writes a response, and returns the bytes written on sc, which may be nil.
+func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex, sc *serverConn) uint64 {
 	sending.Lock()
 	defer sending.Unlock()
+	sent := sc.sent()
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
+	return sc.sent() - sent
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+// handleRequest calls the method of req and sends exactly one response: the
+// reply, or the timeout error if the method takes longer than timeout.
+// The request is counted as being handled until the method returns, even
+// after the timeout, so wg, server.inflight and req.conn are released then.
+// The context passed to the method is cancelled on timeout, or once ctx is done.
+func (server *Server) handleRequest(ctx context.Context, cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+	start := time.Now()
+	atomic.AddUint64(&req.mtype.bytesIn, req.bytesIn)
+	ctx, cancel := context.WithCancel(ctx)
+	// an invalid traceparent starts a new trace
+	parent, _ := ParseTraceparent(req.h.Traceparent)
+	span := server.getTracer().start(parent, req.h.ServiceMethod, SpanKindServer)
+	if span != nil {
+		span.SetAttribute("rpc.seq", strconv.FormatUint(req.h.Seq, 10))
+	}
+	if sc := span.propagate(parent); sc.IsValid() {
+		ctx = ContextWithSpanContext(ctx, sc)
+	}
+	var once sync.Once // the response of the first of the call and the timeout is sent
+	respond := func(h codec.Header, body interface{}) {
+		once.Do(func() {
+			atomic.AddUint64(&req.mtype.bytesOut, server.sendResponse(cc, &h, body, sending, req.conn))
+		})
+	}
+	// buffered, so that a call returning after the timeout doesn't block forever
+	called := make(chan error, 1)
+	sent := make(chan struct{}, 1)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+		defer wg.Done()
+		defer atomic.AddInt64(&server.inflight, -1)
+		defer req.conn.end(req)
+		defer cancel()
+		err := req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+		called <- err
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
-			return
+			h := *req.h
+			h.Error = err.Error()
+			respond(h, invalidRequest)
+		} else {
+			respond(*req.h, req.replyv.Interface())
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
 		sent <- struct{}{}
 	}()
 
 	if timeout == 0 {
-		<-called
+		err := <-called
 		<-sent
+		req.mtype.recordResult(time.Since(start), err, false)
+		span.finish(err)
 		return
 	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
+	case <-t.C:
+		msg := fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+		h := *req.h
+		h.Error = msg
+		respond(h, invalidRequest)
+		cancel() // the reply is no longer expected
+		req.mtype.recordResult(time.Since(start), nil, true)
+		if span != nil {
+			span.SetAttribute("rpc.error_code", "timeout")
+		}
+		span.finish(errors.New(msg))
+	case err := <-called:
 		<-sent
+		req.mtype.recordResult(time.Since(start), err, false)
+		span.finish(err)
 	}
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.shuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 		go server.ServeConn(conn)
@@ -217,6 +356,8 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 //	- two arguments, both of exported type
 //	- the second argument is a pointer
 //	- one return value, of type error
+// The method may take a context.Context before its two arguments, it carries
+// the trace of the request, so that the calls made with it continue the trace.
 func (server *Server) Register(rcvr interface{}) error {
 	s := newService(rcvr)
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
@@ -228,6 +369,21 @@ func (server *Server) Register(rcvr interface{}) error {
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
 
+// ServiceMethods returns the sorted "Service.Method" of every registered method,
+// a server publishes them to the registry along with its heartbeats.
+func (server *Server) ServiceMethods() []string {
+	var methods []string
+	server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		for name := range svc.method {
+			methods = append(methods, svc.name+"."+name)
+		}
+		return true
+	})
+	sort.Strings(methods)
+	return methods
+}
+
 const (
 	connected        = "200 Connected to Gee RPC"
 	defaultRPCPath   = "/_geeprc_"
@@ -0,0 +1,478 @@
+package geerpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geerpc/codec"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Slow int
+
+func (s Slow) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Millisecond * time.Duration(ms))
+	*reply = ms
+	return nil
+}
+
+func (s Slow) Fail(msg string, reply *int) error {
+	if msg == "not found" {
+		return codeError(msg)
+	}
+	return errors.New(msg)
+}
+
+type codeError string
+
+func (e codeError) Error() string { return string(e) }
+func (e codeError) Code() string  { return strings.ReplaceAll(string(e), " ", "_") }
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+
+	var hooked int32
+	server.RegisterOnShutdown(func() { atomic.StoreInt32(&hooked, 1) })
+	done := make(chan int, 1)
+	go func() {
+		var reply int
+		_ = client.Call(context.Background(), "Slow.Sleep", 500, &reply)
+		done <- reply
+	}()
+	for atomic.LoadInt64(&server.inflight) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	for !server.shuttingDown() {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	var reply int
+	err = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), ErrServerShutdown.Error()), "expect new requests to be rejected, got %v", err)
+	_assert(<-done == 500, "expect the request being handled to finish")
+	_assert(<-shutdown == nil, "expect to shut down gracefully")
+	_assert(atomic.LoadInt32(&hooked) == 1, "expect shutdown hooks to be called")
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect the listener to be closed")
+
+	// ctx limits the wait for requests being handled
+	server = NewServer()
+	_ = server.Register(&s)
+	l, _ = net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, _ = Dial("tcp", l.Addr().String())
+	go func() { _ = client.Call(context.Background(), "Slow.Sleep", 2000, &reply) }()
+	for atomic.LoadInt64(&server.inflight) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_assert(server.Shutdown(ctx) == context.DeadlineExceeded, "expect shutdown to give up")
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	conn, serverConn := net.Pipe()
+	defer func() { _ = conn.Close() }()
+	go server.ServeConn(serverConn)
+
+	// the option and the first request in a single write, the request must
+	// not be lost by reading the option
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(DefaultOption)
+	enc := gob.NewEncoder(&buf)
+	_ = enc.Encode(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1})
+	_ = enc.Encode(Args{Num1: 1, Num2: 2})
+	_, err := conn.Write(buf.Bytes())
+	_assert(err == nil, "failed to write: %v", err)
+
+	cc := codec.NewGobCodec(conn)
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "expect the reply of the first request, got %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3, got %d", reply)
+}
+
+// Waiter waits for its context.
+type Waiter int
+
+func (w Waiter) Wait(ctx context.Context, ms int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Millisecond * time.Duration(ms)):
+		*reply = ms
+		return nil
+	}
+}
+
+func TestServer_requestContext(t *testing.T) {
+	start := func(opt *Option) (*Server, *Client) {
+		server := NewServer()
+		var w Waiter
+		_ = server.Register(&w)
+		l, _ := net.Listen("tcp", ":0")
+		go server.Accept(l)
+		client, err := Dial("tcp", l.Addr().String(), opt)
+		_assert(err == nil, "failed to dial: %v", err)
+		return server, client
+	}
+	waitIdle := func(server *Server, msg string) {
+		for i := 0; atomic.LoadInt64(&server.inflight) > 0; i++ {
+			_assert(i < 100, msg)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// cancelled on shutdown
+	server, client := start(nil)
+	called := make(chan error, 1)
+	go func() {
+		var reply int
+		called <- client.Call(context.Background(), "Waiter.Wait", 5000, &reply)
+	}()
+	for atomic.LoadInt64(&server.inflight) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_assert(server.Shutdown(ctx) == nil, "expect the request to return on shutdown")
+	err := <-called
+	_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect the context to be cancelled, got %v", err)
+
+	// cancelled once the connection is closed
+	server, client = start(nil)
+	go func() {
+		var reply int
+		_ = client.Call(context.Background(), "Waiter.Wait", 5000, &reply)
+	}()
+	for atomic.LoadInt64(&server.inflight) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_ = client.Close()
+	waitIdle(server, "expect the request to return once the connection is closed")
+
+	// cancelled on handle timeout
+	server, client = start(&Option{HandleTimeout: time.Millisecond * 50})
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Waiter.Wait", 5000, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout, got %v", err)
+	waitIdle(server, "expect the request to return on timeout")
+}
+
+// recordingCodec records the headers of the responses written.
+type recordingCodec struct {
+	mu      sync.Mutex
+	headers []codec.Header
+}
+
+func (c *recordingCodec) ReadHeader(*codec.Header) error { return errNothingToRead }
+func (c *recordingCodec) ReadBody(interface{}) error     { return errNothingToRead }
+func (c *recordingCodec) Close() error                   { return nil }
+
+func (c *recordingCodec) Write(h *codec.Header, _ interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = append(c.headers, *h)
+	return nil
+}
+
+func (c *recordingCodec) written() []codec.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]codec.Header(nil), c.headers...)
+}
+
+func TestServer_handleRequestTimeout(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	req := &request{h: &codec.Header{ServiceMethod: "Slow.Sleep", Seq: 1}}
+	req.svc, req.mtype, _ = server.findService(req.h.ServiceMethod)
+	req.argv, req.replyv = req.mtype.newArgv(), req.mtype.newReplyv()
+	req.argv.SetInt(200)
+	sc := &serverConn{requests: make(map[*request]time.Time)}
+	req.conn = sc
+	sc.begin(req)
+	atomic.AddInt64(&server.inflight, 1)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+
+	cc := new(recordingCodec)
+	server.handleRequest(context.Background(), cc, req, new(sync.Mutex), wg, time.Millisecond*50)
+	headers := cc.written()
+	_assert(len(headers) == 1 && strings.Contains(headers[0].Error, "handle timeout"), "expect a timeout response, got %+v", headers)
+	_assert(atomic.LoadInt64(&server.inflight) == 1 && len(sc.info(time.Now()).Requests) == 1,
+		"expect the request to be handled until the method returns")
+
+	wg.Wait()
+	headers = cc.written()
+	_assert(len(headers) == 1, "expect a single response, got %+v", headers)
+	_assert(atomic.LoadInt64(&server.inflight) == 0 && len(sc.info(time.Now()).Requests) == 0,
+		"expect the request to be done once the method returns")
+	_assert(req.h.Error == "", "expect the header of the request to be left alone, got %q", req.h.Error)
+}
+
+func TestDebugHTTP_json(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	var foo Foo
+	_ = server.Register(&s)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Slow.Sleep", 20, &reply)
+	_ = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_ = client.Call(context.Background(), "Slow.Fail", "oops", &reply)
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+	var page struct{ Services []DebugService }
+	_assert(json.NewDecoder(w.Body).Decode(&page) == nil, "expect a json page")
+	_assert(len(page.Services) == 2 && page.Services[0].Name == "Foo" && page.Services[1].Name == "Slow",
+		"expect services sorted by name, got %+v", page.Services)
+	methods := page.Services[1].Methods
+	_assert(len(methods) == 2 && methods[0].Name == "Fail" && methods[1].Name == "Sleep", "expect methods sorted by name, got %+v", methods)
+	_assert(methods[0].Calls == 1 && methods[0].Errors == 1 && methods[0].ArgType == "string" && methods[0].ReplyType == "*int",
+		"wrong Slow.Fail %+v", methods[0])
+	sleep := methods[1]
+	_assert(sleep.Calls == 2 && sleep.Errors == 0 && sleep.MaxLatencyMs >= 20 && sleep.MeanLatencyMs >= 10 && sleep.MeanLatencyMs < sleep.MaxLatencyMs,
+		"wrong Slow.Sleep %+v", sleep)
+
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	html := w.Body.String()
+	_assert(strings.Index(html, "Service Foo") < strings.Index(html, "Service Slow"), "expect sorted services in html")
+}
+
+func TestServer_Stats(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String(), &Option{HandleTimeout: time.Millisecond * 100})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_ = client.Call(context.Background(), "Slow.Sleep", 30, &reply)
+	_ = client.Call(context.Background(), "Slow.Fail", "oops", &reply)
+	_ = client.Call(context.Background(), "Slow.Fail", "not found", &reply)
+	_ = client.Call(context.Background(), "Slow.Fail", "not found", &reply)
+	go func() { _ = client.Call(context.Background(), "Slow.Sleep", 300, &reply) }()
+	time.Sleep(time.Millisecond * 200)
+
+	stats := server.Stats()
+	_assert(len(stats) == 2 && stats[0].Method == "Fail" && stats[1].Method == "Sleep", "expect sorted stats, got %+v", stats)
+	fail, sleep := stats[0], stats[1]
+	_assert(fail.Service == "Slow" && fail.Calls == 3 && fail.Successes == 0, "wrong stats of Slow.Fail %+v", fail)
+	_assert(fail.Errors["error"] == 1 && fail.Errors["not_found"] == 2, "expect errors by code, got %v", fail.Errors)
+	_assert(sleep.Calls == 3 && sleep.Successes == 2 && sleep.Timeouts == 1 && sleep.InFlight == 1,
+		"expect the slow call to time out and to be running, got %+v", sleep)
+	_assert(sleep.CallLatency.Count == 2 && sleep.CallLatency.Counts[0] == 1 && sleep.CallLatency.Counts[4] == 1,
+		"expect calls in the <=1ms and <=50ms buckets, got %v", sleep.CallLatency)
+	_assert(sleep.HandleLatency.Count == 3 && sleep.HandleLatency.Counts[6] == 1, "expect the timeout in the <=250ms bucket, got %v", sleep.HandleLatency)
+
+	time.Sleep(time.Millisecond * 150)
+	sleep = server.Stats()[1]
+	_assert(sleep.InFlight == 0 && sleep.Calls == 3 && sleep.Successes == 2, "expect the timed out call not to be a success, got %+v", sleep)
+}
+
+func TestServer_HandleMetrics(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	metrics := NewClientMetrics()
+	client, err := Dial("tcp", l.Addr().String(), &Option{HandleTimeout: time.Millisecond * 100, Metrics: metrics})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_ = client.Call(context.Background(), "Slow.Fail", "not found", &reply)
+	_ = client.Call(context.Background(), "Slow.Sleep", 150, &reply)
+	metrics.RecordFanout("Slow.Sleep", 2)
+
+	w := httptest.NewRecorder()
+	metricsHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	_assert(strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"), "expect the text format")
+	text := w.Body.String()
+	for _, line := range []string{
+		"# TYPE geerpc_server_requests_total counter",
+		`geerpc_server_requests_total{service="Slow",method="Sleep"} 2`,
+		`geerpc_server_errors_total{service="Slow",method="Fail",code="not_found"} 1`,
+		`geerpc_server_errors_total{service="Slow",method="Sleep",code="timeout"} 1`,
+		"# TYPE geerpc_server_request_duration_seconds histogram",
+		`geerpc_server_request_duration_seconds_bucket{service="Slow",method="Sleep",le="0.001"} 1`,
+		`geerpc_server_request_duration_seconds_bucket{service="Slow",method="Sleep",le="+Inf"} 2`,
+		`geerpc_server_request_duration_seconds_count{service="Slow",method="Sleep"} 2`,
+		`geerpc_server_in_flight{service="Slow",method="Sleep"} 1`,
+		"geerpc_server_connections 1",
+	} {
+		_assert(strings.Contains(text, line+"\n"), "expect %q in metrics:\n%s", line, text)
+	}
+	// every byte but the option line belongs to a request, and every reply to a method
+	var bytesIn, bytesOut uint64
+	for _, s := range server.Stats() {
+		_assert(s.BytesIn > 0 && s.BytesOut > 0, "expect bytes of %s.%s to be counted, got %+v", s.Service, s.Method, s)
+		_assert(strings.Contains(text, fmt.Sprintf("geerpc_server_received_bytes_total{service=%q,method=%q} %d\n", s.Service, s.Method, s.BytesIn)) &&
+			strings.Contains(text, fmt.Sprintf("geerpc_server_sent_bytes_total{service=%q,method=%q} %d\n", s.Service, s.Method, s.BytesOut)),
+			"expect bytes by method in metrics:\n%s", text)
+		bytesIn += s.BytesIn
+		bytesOut += s.BytesOut
+	}
+	conn := server.Conns()[0]
+	_assert(conn.BytesOut == bytesOut && conn.BytesIn > bytesIn && conn.BytesIn-bytesIn < 200,
+		"expect the bytes of the connection to be split by method, got %d/%d and %d/%d", bytesIn, conn.BytesIn, bytesOut, conn.BytesOut)
+
+	w = httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	text = w.Body.String()
+	target := "tcp@" + l.Addr().String()
+	for _, line := range []string{
+		`geerpc_client_requests_total{target="` + target + `",service="Slow",method="Sleep"} 2`,
+		`geerpc_client_errors_total{target="` + target + `",service="Slow",method="Fail"} 1`,
+		`geerpc_client_errors_total{target="` + target + `",service="Slow",method="Sleep"} 1`,
+		`geerpc_client_request_duration_seconds_count{target="` + target + `",service="Slow",method="Fail"} 1`,
+		`geerpc_client_fanout_requests_total{service="Slow",method="Sleep"} 2`,
+	} {
+		_assert(strings.Contains(text, line+"\n"), "expect %q in metrics:\n%s", line, text)
+	}
+	_assert(formatLabels([]string{"code", "a\"b\\c\nd"}) == `{code="a\"b\\c\nd"}`, "expect label values to be escaped")
+}
+
+func TestDebugHTTP_conns(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	done := make(chan error, 1)
+	go func() { done <- client.Call(context.Background(), "Slow.Sleep", 500, &reply) }()
+	time.Sleep(time.Millisecond * 100)
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+	var page struct{ Connections []ConnInfo }
+	_assert(json.NewDecoder(w.Body).Decode(&page) == nil, "expect a json page")
+	_assert(len(page.Connections) == 1, "expect 1 connection, got %+v", page.Connections)
+	conn := page.Connections[0]
+	_assert(conn.RemoteAddr != "" && conn.Codec == codec.GobType && conn.BytesIn > 0 && conn.BytesOut > 0,
+		"wrong connection %+v", conn)
+	_assert(len(conn.Requests) == 1 && conn.Requests[0].ServiceMethod == "Slow.Sleep" && conn.Requests[0].Seq == 2 &&
+		conn.Requests[0].Elapsed >= time.Millisecond*100, "expect the slow request in flight, got %+v", conn.Requests)
+
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "Slow.Sleep") && strings.Contains(w.Body.String(), conn.RemoteAddr),
+		"expect the connection and the request in html")
+
+	_assert(!strings.Contains(w.Body.String(), "name=close"), "expect no close button by default")
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("POST", defaultDebugPath+"?close="+strconv.FormatUint(conn.ID, 10), nil))
+	_assert(w.Code == http.StatusForbidden && len(server.Conns()) == 1, "expect closing to be disabled by default, got %d", w.Code)
+
+	server.SetDebugOption(&DebugOption{AllowClose: true})
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(w.Body.String(), "name=close"), "expect a close button once allowed")
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("POST", defaultDebugPath+"?close=42", nil))
+	_assert(w.Code == http.StatusNotFound, "expect an unknown connection not to be found, got %d", w.Code)
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("POST", defaultDebugPath+"?close="+strconv.FormatUint(conn.ID, 10), nil))
+	_assert(w.Code == http.StatusSeeOther, "expect to go back to the page, got %d", w.Code)
+	_assert(<-done != nil, "expect the call to fail once its connection is closed")
+	_assert(!client.IsAvailable(), "expect the client to be shut down")
+	// the connection is listed until the requests being handled on it return
+	time.Sleep(time.Millisecond * 500)
+	_assert(len(server.Conns()) == 0, "expect the connection to be removed, got %+v", server.Conns())
+}
+
+func TestDebugHTTP_call(t *testing.T) {
+	server := NewServer()
+	var s Slow
+	var foo Foo
+	_ = server.Register(&s)
+	_ = server.Register(&foo)
+	post := func(form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", defaultDebugPath+"?format=json", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		debugHTTP{server}.ServeHTTP(w, req)
+		return w
+	}
+	call := func(form string) (reply, err string) {
+		var result struct {
+			Reply json.RawMessage
+			Error string
+		}
+		w := post(form)
+		_assert(json.NewDecoder(w.Body).Decode(&result) == nil, "expect a json result of %s", form)
+		return string(result.Reply), result.Error
+	}
+
+	w := post(`call=Foo.Sum&arg={"Num1":1,"Num2":2}`)
+	_assert(w.Code == http.StatusForbidden, "expect calls to be disabled by default, got %d", w.Code)
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(!strings.Contains(w.Body.String(), `name=call`), "expect no call form by default")
+
+	server.SetDebugOption(&DebugOption{AllowCalls: true, CallTimeout: time.Millisecond * 100})
+	reply, err := call(`call=Foo.Sum&arg={"Num1":1,"Num2":2}`)
+	_assert(reply == "3" && err == "", "expect reply 3, got %s: %s", reply, err)
+	reply, err = call(`call=Slow.Sleep&arg=`)
+	_assert(reply == "0" && err == "", "expect an empty argument to be the zero value, got %s: %s", reply, err)
+	_, err = call(`call=Foo.Sum&arg={"Num1":"one"}`)
+	_assert(strings.Contains(err, "invalid argument of type geerpc.Args"), "expect an invalid argument, got %s", err)
+	_, err = call(`call=Foo.Unknown&arg=1`)
+	_assert(strings.Contains(err, "can't find method"), "expect an unknown method, got %s", err)
+	_, err = call(`call=Slow.Fail&arg="not found"`)
+	_assert(err == "not found", "expect the error of the method, got %s", err)
+	_, err = call(`call=Slow.Sleep&arg=300`)
+	_assert(strings.Contains(err, "handle timeout"), "expect the call to time out, got %s", err)
+	stats := server.Stats()
+	_assert(stats[0].Method == "Sum" && stats[0].Successes == 1 && stats[1].Method == "Fail" && stats[1].Errors["not_found"] == 1 &&
+		stats[2].Method == "Sleep" && stats[2].Timeouts == 1, "expect the calls to be counted, got %+v", stats)
+
+	req := httptest.NewRequest("POST", defaultDebugPath, strings.NewReader(`call=Foo.Sum&arg={"Num1":2,"Num2":2}`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, req)
+	html := w.Body.String()
+	_assert(strings.Contains(html, `name=call value="Foo.Sum"`) && strings.Contains(html, "<pre>4</pre>"), "expect the form and the reply in html:\n%s", html)
+}
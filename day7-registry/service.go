@@ -1,23 +1,71 @@
 package geerpc
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64
+	method       reflect.Method
+	ArgType      reflect.Type
+	ReplyType    reflect.Type
+	withContext  bool // the method takes a context.Context first
+	numCalls     uint64
+	numSuccesses uint64
+	numTimeouts  uint64
+	inFlight     int64
+	bytesIn      uint64 // bytes of the requests, as read by the codec
+	bytesOut     uint64 // bytes of the replies, as written by the codec
+	maxLatency   int64  // in ns
+	callLatency  histogram
+	// handleLatency covers the whole request, see Server.handleRequest
+	handleLatency histogram
+
+	mu         sync.Mutex // protect following
+	errorCodes map[string]uint64
 }
 
+// NumCalls returns the number of calls started, including the ones running.
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// NumErrors returns the number of requests replied with an error.
+func (m *methodType) NumErrors() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n uint64
+	for _, count := range m.errorCodes {
+		n += count
+	}
+	return n
+}
+
+// MeanLatency returns the mean duration of the calls, 0 if none.
+func (m *methodType) MeanLatency() time.Duration {
+	return m.callLatency.snapshot().Mean()
+}
+
+func (m *methodType) MaxLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.maxLatency))
+}
+
+// record records a call which took d.
+func (m *methodType) record(d time.Duration) {
+	m.callLatency.observe(d)
+	for {
+		max := atomic.LoadInt64(&m.maxLatency)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&m.maxLatency, max, int64(d)) {
+			return
+		}
+	}
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// arg may be a pointer type, or a value type
@@ -60,34 +108,50 @@ func newService(rcvr interface{}) *service {
 	return s
 }
 
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		// methods may take a context.Context first, carrying the trace of the request
+		withContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if (mType.NumIn() != 3 && !withContext) || mType.NumOut() != 1 {
 			continue
 		}
 		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
 		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
+	start := time.Now()
+	atomic.AddInt64(&m.inFlight, 1)
+	defer func() {
+		// the mean latency only covers done calls, see MethodStats.CallLatency
+		m.record(time.Since(start))
+		atomic.AddInt64(&m.inFlight, -1)
+	}()
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withContext {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
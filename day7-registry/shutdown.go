@@ -0,0 +1,131 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerShutdown is returned to requests received while the server is shutting down.
+var ErrServerShutdown = errors.New("rpc server: server is shutting down")
+
+const shutdownPollInterval = time.Millisecond * 50
+
+// RegisterOnShutdown registers f to be called when Shutdown starts,
+// eg. to deregister the server from the registry before it stops serving.
+func (server *Server) RegisterOnShutdown(f func()) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onShutdown = append(server.onShutdown, f)
+}
+
+// Shutdown gracefully shuts down the server: it calls the functions registered
+// by RegisterOnShutdown, closes the listeners passed to Accept, rejects new
+// requests with ErrServerShutdown, waits for the requests being handled,
+// then closes all connections.
+// The context of the requests being handled is cancelled, so that methods
+// taking a context.Context may return early, eg. long polls like registry watches.
+// If ctx is done before the requests are handled, the connections are
+// closed anyway and ctx.Err() is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.inShutdown = true
+	hooks := server.onShutdown
+	server.onShutdown = nil
+	server.mu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	server.context() // so that the context is done even if no request was received
+	server.cancel()
+
+	server.mu.Lock()
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	server.mu.Unlock()
+
+	var err error
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for atomic.LoadInt64(&server.inflight) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for conn := range server.conns {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// context returns the parent of the contexts of the requests, done on Shutdown.
+func (server *Server) context() context.Context {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.ctx == nil {
+		server.ctx, server.cancel = context.WithCancel(context.Background())
+	}
+	return server.ctx
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// trackListener adds or removes lis, and returns false if the server is shutting down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn adds conn, and returns nil if the server is shutting down.
+func (server *Server) trackConn(conn io.ReadWriteCloser) *serverConn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.inShutdown {
+		return nil
+	}
+	if server.conns == nil {
+		server.conns = make(map[io.Closer]*serverConn)
+	}
+	server.lastConnID++
+	c := &serverConn{
+		id:          server.lastConnID,
+		remoteAddr:  remoteAddr(conn),
+		connectedAt: time.Now(),
+		closer:      conn,
+		requests:    make(map[*request]time.Time),
+	}
+	server.conns[conn] = c
+	return c
+}
+
+// untrackConn removes conn once it's closed.
+func (server *Server) untrackConn(conn io.Closer) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.conns, conn)
+}
@@ -0,0 +1,185 @@
+package geerpc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of the latency histograms.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// ErrorCoder is implemented by errors with a code, eg. "not_found".
+// The errors returned by methods are counted by code in MethodStats,
+// the ones without code are counted as "error".
+type ErrorCoder interface {
+	Code() string
+}
+
+const defaultErrorCode = "error"
+
+func errorCode(err error) string {
+	var c ErrorCoder
+	if errors.As(err, &c) && c.Code() != "" {
+		return c.Code()
+	}
+	return defaultErrorCode
+}
+
+// Histogram counts durations in fixed buckets: Counts[i] is the number of
+// durations <= Bounds[i] and > Bounds[i-1], the last count is the number
+// of durations above every bound.
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+	Count  uint64          `json:"count"`
+	Sum    time.Duration   `json:"sum"`
+}
+
+// Mean returns the mean duration, 0 if none.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// String returns the non-empty buckets, eg. "<=1ms: 3 <=5ms: 1 >10s: 1".
+func (h Histogram) String() string {
+	var b strings.Builder
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		if i < len(h.Bounds) {
+			fmt.Fprintf(&b, "<=%s: %d", h.Bounds[i], n)
+		} else {
+			fmt.Fprintf(&b, ">%s: %d", h.Bounds[len(h.Bounds)-1], n)
+		}
+	}
+	return b.String()
+}
+
+// histogram is the concurrent version of Histogram, accessed atomically.
+type histogram struct {
+	counts [len(latencyBounds) + 1]uint64
+	count  uint64
+	sum    int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: append([]time.Duration(nil), latencyBounds[:]...),
+		Counts: make([]uint64, len(h.counts)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// MethodStats are the counters of a method since the server started.
+// A request is either a success, an error or a timeout once it's handled,
+// a request timing out is not counted again when its method returns.
+type MethodStats struct {
+	Service       string            `json:"service"`
+	Method        string            `json:"method"`
+	Calls         uint64            `json:"calls"`     // calls of the method started, CallLatency.Count are the ones done
+	Successes     uint64            `json:"successes"` // requests replied without error
+	Errors        map[string]uint64 `json:"errors"`    // requests replied with an error, by code, see ErrorCoder
+	Timeouts      uint64            `json:"timeouts"`  // requests not handled within the handle timeout
+	InFlight      int64             `json:"in_flight"` // calls of the method running
+	CallLatency   Histogram         `json:"call_latency"`
+	HandleLatency Histogram         `json:"handle_latency"` // from the start of the call to the reply sent
+	BytesIn       uint64            `json:"bytes_in"`       // bytes of the requests received
+	BytesOut      uint64            `json:"bytes_out"`      // bytes of the replies sent, 0 for calls from the debug page
+}
+
+// Stats returns the counters of m, without its names.
+func (m *methodType) Stats() MethodStats {
+	s := MethodStats{
+		Calls:         m.NumCalls(),
+		Successes:     atomic.LoadUint64(&m.numSuccesses),
+		Errors:        make(map[string]uint64),
+		Timeouts:      atomic.LoadUint64(&m.numTimeouts),
+		InFlight:      atomic.LoadInt64(&m.inFlight),
+		CallLatency:   m.callLatency.snapshot(),
+		HandleLatency: m.handleLatency.snapshot(),
+		BytesIn:       atomic.LoadUint64(&m.bytesIn),
+		BytesOut:      atomic.LoadUint64(&m.bytesOut),
+	}
+	m.mu.Lock()
+	for code, n := range m.errorCodes {
+		s.Errors[code] = n
+	}
+	m.mu.Unlock()
+	return s
+}
+
+// recordResult records the result of a request handled in d, err is the error
+// of the method, timeout reports whether it timed out before the method returned.
+func (m *methodType) recordResult(d time.Duration, err error, timeout bool) {
+	m.handleLatency.observe(d)
+	switch {
+	case timeout:
+		atomic.AddUint64(&m.numTimeouts, 1)
+	case err != nil:
+		m.mu.Lock()
+		if m.errorCodes == nil {
+			m.errorCodes = make(map[string]uint64)
+		}
+		m.errorCodes[errorCode(err)]++
+		m.mu.Unlock()
+	default:
+		atomic.AddUint64(&m.numSuccesses, 1)
+	}
+}
+
+// Stats returns the counters of every method, sorted by service and method.
+func (server *Server) Stats() []MethodStats {
+	var stats []MethodStats
+	server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		for name, m := range svc.method {
+			s := m.Stats()
+			s.Service, s.Method = svc.name, name
+			stats = append(stats, s)
+		}
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Service != stats[j].Service {
+			return stats[i].Service < stats[j].Service
+		}
+		return stats[i].Method < stats[j].Method
+	})
+	return stats
+}
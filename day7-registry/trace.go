@@ -0,0 +1,284 @@
+package geerpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traces follow the W3C Trace Context: a request carries the traceparent
+// of the span which sent it in codec.Header, eg.
+//
+//	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+// that is the version, the trace ID, the ID of the parent span and the flags.
+// The server continues the trace of the request, and the calls a method makes
+// with the context it's given continue it as well, see Server.Register.
+
+// TraceID identifies a trace, it's shared by all the spans of the trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+// MarshalText encodes the ID as lowercase hex, in json too.
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+func (id SpanID) MarshalText() ([]byte, error)  { return []byte(id.String()), nil }
+
+func (id *TraceID) UnmarshalText(text []byte) error { return decodeID(id[:], string(text)) }
+func (id *SpanID) UnmarshalText(text []byte) error  { return decodeID(id[:], string(text)) }
+
+func decodeID(dst []byte, s string) error {
+	if !isLowerHex(s, hex.EncodedLen(len(dst))) {
+		return fmt.Errorf("invalid id %q", s)
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// SpanContext is the part of a span propagated to the spans it causes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool // spans of unsampled traces are not recorded, only propagated
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent returns sc in the traceparent format, "" if sc is invalid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errInvalidTraceparent = errors.New("rpc trace: invalid traceparent")
+
+// ParseTraceparent parses a traceparent. Versions above 00 are parsed as 00,
+// ignoring the fields they may append.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		!isLowerHex(parts[3], 2) {
+		return sc, errInvalidTraceparent
+	}
+	if decodeID(sc.TraceID[:], parts[1]) != nil || decodeID(sc.SpanID[:], parts[2]) != nil || !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	sc.Sampled = flags&1 == 1
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc, the calls made
+// with it are children of sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, if any.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+type SpanKind string
+
+const (
+	SpanKindClient SpanKind = "client"
+	SpanKindServer SpanKind = "server"
+)
+
+const (
+	SpanStatusOK    = "ok"
+	SpanStatusError = "error"
+)
+
+// Span is the timing and the result of a call, on the client or on the server.
+type Span struct {
+	Name       string            `json:"name"` // service method
+	Kind       SpanKind          `json:"kind"`
+	TraceID    TraceID           `json:"trace_id"`
+	SpanID     SpanID            `json:"span_id"`
+	ParentID   SpanID            `json:"parent_id"` // zero for the root span of a trace
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Status     string            `json:"status"`          // SpanStatusOK or SpanStatusError
+	Error      string            `json:"error,omitempty"` // error of the call
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	tracer *Tracer
+}
+
+// Duration returns the time the call took.
+func (s *Span) Duration() time.Duration { return s.End.Sub(s.Start) }
+
+func (s *Span) SpanContext() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Sampled: true}
+}
+
+// SetAttribute sets an attribute of s, it's not safe to call once s is finished.
+func (s *Span) SetAttribute(key, value string) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// propagate returns the span context of the calls made within s,
+// parent if s isn't recorded.
+func (s *Span) propagate(parent SpanContext) SpanContext {
+	if s == nil {
+		return parent
+	}
+	return s.SpanContext()
+}
+
+// finish ends s with the result of the call and exports it, nil s is a no-op.
+// The error code is the one of err, unless it's already set.
+func (s *Span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Status = SpanStatusOK
+	if err != nil {
+		s.Status = SpanStatusError
+		s.Error = err.Error()
+		if _, ok := s.Attributes["rpc.error_code"]; !ok {
+			s.SetAttribute("rpc.error_code", errorCode(err))
+		}
+	}
+	s.tracer.export(s)
+}
+
+// SpanExporter receives the spans once they are finished, eg. to send them
+// to a tracing backend. ExportSpan is called by the goroutine of the call,
+// so it should be quick and safe for concurrent use.
+type SpanExporter interface {
+	ExportSpan(span *Span) error
+}
+
+// Tracer records the spans of the calls of clients and servers, and sends
+// them to its exporter. Without exporter, no span is recorded, the trace
+// context of requests is only propagated.
+type Tracer struct {
+	mu       sync.RWMutex
+	exporter SpanExporter
+}
+
+// DefaultTracer is the Tracer of the servers and clients without one,
+// it has no exporter until SetExporter is called.
+var DefaultTracer = NewTracer(nil)
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// SetExporter replaces the exporter of t, nil stops recording spans.
+func (t *Tracer) SetExporter(exporter SpanExporter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exporter = exporter
+}
+
+func (t *Tracer) enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.exporter != nil
+}
+
+// start starts a span of the call of serviceMethod, child of parent if valid,
+// the root of a new trace otherwise. It returns nil if the span isn't recorded.
+func (t *Tracer) start(parent SpanContext, serviceMethod string, kind SpanKind) *Span {
+	if !t.enabled() || (parent.IsValid() && !parent.Sampled) {
+		return nil
+	}
+	s := &Span{
+		Name:    serviceMethod,
+		Kind:    kind,
+		TraceID: parent.TraceID,
+		Start:   time.Now(),
+		tracer:  t,
+	}
+	if parent.IsValid() {
+		s.ParentID = parent.SpanID
+	} else {
+		_, _ = rand.Read(s.TraceID[:])
+	}
+	_, _ = rand.Read(s.SpanID[:])
+	service, method := splitServiceMethod(serviceMethod)
+	s.SetAttribute("rpc.system", "geerpc")
+	s.SetAttribute("rpc.service", service)
+	s.SetAttribute("rpc.method", method)
+	return s
+}
+
+func (t *Tracer) export(s *Span) {
+	t.mu.RLock()
+	exporter := t.exporter
+	t.mu.RUnlock()
+	if exporter == nil {
+		return
+	}
+	if err := exporter.ExportSpan(s); err != nil {
+		log.Println("rpc trace: export span error:", err)
+	}
+}
+
+// SetTracer sets the tracer of the requests handled by the server,
+// nil means DefaultTracer.
+func (server *Server) SetTracer(t *Tracer) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.tracer = t
+}
+
+func (server *Server) getTracer() *Tracer {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.tracer == nil {
+		return DefaultTracer
+	}
+	return server.tracer
+}
+
+func (client *Client) tracer() *Tracer {
+	if client.opt.Tracer != nil {
+		return client.opt.Tracer
+	}
+	return DefaultTracer
+}
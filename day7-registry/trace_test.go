@@ -0,0 +1,144 @@
+package geerpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_assert(err == nil && sc.Sampled && sc.TraceID.String() == "4bf92f3577b34da6a3ce929d0e0e4736" && sc.SpanID.String() == "00f067aa0ba902b7",
+		"failed to parse traceparent: %+v, %v", sc, err)
+	_assert(sc.Traceparent() == "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "expect the same traceparent, got %s", sc.Traceparent())
+	sc, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	_assert(err == nil && !sc.Sampled, "expect future versions to be parsed, got %v", err)
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(s)
+		_assert(err != nil, "expect %q to be invalid", s)
+	}
+}
+
+// Front calls Back on another server, within the trace of its request.
+type Front struct {
+	client *Client
+}
+
+func (f *Front) Sum(ctx context.Context, args Args, reply *int) error {
+	return f.client.Call(ctx, "Foo.Sum", args, reply)
+}
+
+func startTracedServer(tracer *Tracer, rcvr interface{}) string {
+	server := NewServer()
+	server.SetTracer(tracer)
+	_ = server.Register(rcvr)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	return l.Addr().String()
+}
+
+func TestTracer(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+	var foo Foo
+	backAddr := startTracedServer(tracer, &foo)
+	back, err := Dial("tcp", backAddr, &Option{Tracer: tracer})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = back.Close() }()
+	frontAddr := startTracedServer(tracer, &Front{client: back})
+	front, err := Dial("tcp", frontAddr, &Option{Tracer: tracer})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = front.Close() }()
+
+	var reply int
+	err = front.Call(context.Background(), "Front.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect reply 3, got %d: %v", reply, err)
+	spans := waitSpans(exporter, 4)
+	_assert(len(spans) == 4, "expect 4 spans, got %d", len(spans))
+	// server spans finish once the reply is sent, maybe after the client span
+	byName := make(map[string]Span)
+	for _, s := range spans {
+		byName[string(s.Kind)+" "+s.Name] = s
+	}
+	frontClient, frontServer := byName["client Front.Sum"], byName["server Front.Sum"]
+	backClient, backServer := byName["client Foo.Sum"], byName["server Foo.Sum"]
+	_assert(frontClient.Kind == SpanKindClient && frontClient.Name == "Front.Sum" && !frontClient.ParentID.IsValid(),
+		"expect the root client span, got %+v", frontClient)
+	_assert(frontServer.Kind == SpanKindServer && frontServer.ParentID == frontClient.SpanID, "expect the server span of Front.Sum, got %+v", frontServer)
+	_assert(backClient.Kind == SpanKindClient && backClient.Name == "Foo.Sum" && backClient.ParentID == frontServer.SpanID,
+		"expect the downstream call to be a child of the server span, got %+v", backClient)
+	_assert(backServer.Kind == SpanKindServer && backServer.ParentID == backClient.SpanID, "expect the server span of Foo.Sum, got %+v", backServer)
+	for _, s := range spans {
+		_assert(s.TraceID == frontClient.TraceID && s.Status == SpanStatusOK && s.Duration() > 0, "expect a single trace of successful spans, got %+v", s)
+	}
+	_assert(frontClient.Attributes["net.peer.name"] == "tcp@"+frontAddr && frontServer.Attributes["rpc.method"] == "Sum",
+		"expect attributes, got %v and %v", frontClient.Attributes, frontServer.Attributes)
+
+	// the trace of ctx is continued, and errors are recorded
+	exporter.Reset()
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	err = back.Call(ContextWithSpanContext(context.Background(), parent), "Foo.Unknown", Args{}, &reply)
+	_assert(err != nil, "expect an unknown method to fail")
+	spans = exporter.Spans()
+	_assert(len(spans) == 1 && spans[0].TraceID == parent.TraceID && spans[0].ParentID == parent.SpanID && spans[0].Status == SpanStatusError,
+		"expect a failed span in the trace of ctx, got %+v", spans)
+
+	// unsampled traces are propagated, not recorded
+	exporter.Reset()
+	parent.Sampled = false
+	_ = front.Call(ContextWithSpanContext(context.Background(), parent), "Front.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(len(exporter.Spans()) == 0, "expect no span of an unsampled trace, got %+v", exporter.Spans())
+}
+
+// waitSpans waits a bit for n spans to be exported.
+func waitSpans(exporter *MemoryExporter, n int) []Span {
+	for i := 0; i < 100 && len(exporter.Spans()) < n; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	return exporter.Spans()
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := NewFileExporter(path)
+	_assert(err == nil, "failed to open exporter: %v", err)
+	var foo Foo
+	addr := startTracedServer(NewTracer(exporter), &foo)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 3, Num2: 4}, &reply)
+	_ = client.Close()
+	time.Sleep(time.Millisecond * 50) // the spans finish once the replies are sent
+	_assert(exporter.Close() == nil, "failed to close exporter")
+
+	f, err := os.Open(path)
+	_assert(err == nil, "failed to open spans: %v", err)
+	defer func() { _ = f.Close() }()
+	var spans []Span
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s Span
+		_assert(json.Unmarshal(scanner.Bytes(), &s) == nil, "expect a span per line, got %s", scanner.Text())
+		spans = append(spans, s)
+	}
+	_assert(len(spans) == 2 && spans[0].Name == "Foo.Sum" && spans[0].Kind == SpanKindServer && spans[0].TraceID.IsValid(),
+		"expect 2 server spans, got %+v", spans)
+	_assert(spans[0].TraceID != spans[1].TraceID, "expect calls without trace to start new traces")
+}
@@ -0,0 +1,147 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"geerpc/registry"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Balancer picks a server for a call from the servers currently
+// provided by a Discovery. It is independent of where the servers
+// come from, so a custom strategy works with any Discovery.
+type Balancer interface {
+	Pick(ctx context.Context, servers []string) (string, error)
+}
+
+var errNoServers = errors.New("rpc discovery: no available servers")
+
+// NewBalancer returns the built-in Balancer of mode.
+func NewBalancer(mode SelectMode) (Balancer, error) {
+	switch mode {
+	case RandomSelect:
+		return newRandomBalancer(), nil
+	case RoundRobinSelect:
+		return newRoundRobinBalancer(), nil
+	case ConsistentHashSelect:
+		return newConsistentHashBalancer(defaultReplicas, nil), nil
+	default:
+		return nil, errors.New("rpc discovery: not supported select mode")
+	}
+}
+
+// weightedBalancer picks a server randomly in proportion to its weight.
+type weightedBalancer struct {
+	d InstanceDiscovery
+	*randomBalancer
+}
+
+// NewWeightedBalancer returns a Balancer picking servers randomly in proportion
+// to the weight registered in their metadata, servers without weight count as 1.
+func NewWeightedBalancer(d InstanceDiscovery) Balancer {
+	return &weightedBalancer{d: d, randomBalancer: newRandomBalancer()}
+}
+
+func (b *weightedBalancer) Pick(_ context.Context, servers []string) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	weights := make([]int, len(servers))
+	total := 0
+	for i, rpcAddr := range servers {
+		weights[i] = 1
+		if item, ok := b.d.Instance(rpcAddr); ok && item.Weight > 0 {
+			weights[i] = item.Weight
+		}
+		total += weights[i]
+	}
+	b.mu.Lock()
+	n := b.r.Intn(total)
+	b.mu.Unlock()
+	for i, w := range weights {
+		if n < w {
+			return servers[i], nil
+		}
+		n -= w
+	}
+	return servers[len(servers)-1], nil
+}
+
+// preferBalancer narrows the servers down to the preferred ones before next picks.
+type preferBalancer struct {
+	d      InstanceDiscovery
+	prefer func(item registry.ServerItem) bool
+	next   Balancer
+}
+
+// NewPreferBalancer returns a Balancer letting next pick among the servers whose
+// metadata matches prefer, or among all servers if none matches. eg, same zone first:
+//
+//	NewPreferBalancer(d, func(s registry.ServerItem) bool { return s.Zone == zone }, next)
+func NewPreferBalancer(d InstanceDiscovery, prefer func(item registry.ServerItem) bool, next Balancer) Balancer {
+	return &preferBalancer{d: d, prefer: prefer, next: next}
+}
+
+func (b *preferBalancer) Pick(ctx context.Context, servers []string) (string, error) {
+	var preferred []string
+	for _, rpcAddr := range servers {
+		if item, ok := b.d.Instance(rpcAddr); ok && b.prefer(item) {
+			preferred = append(preferred, rpcAddr)
+		}
+	}
+	if len(preferred) == 0 {
+		preferred = servers
+	}
+	return b.next.Pick(ctx, preferred)
+}
+
+// errBalancer fails every pick, it stands in for an unsupported SelectMode.
+type errBalancer struct{ err error }
+
+func (b errBalancer) Pick(context.Context, []string) (string, error) { return "", b.err }
+
+// randomBalancer picks a server randomly.
+type randomBalancer struct {
+	mu sync.Mutex // protect r
+	r  *rand.Rand
+}
+
+func newRandomBalancer() *randomBalancer {
+	return &randomBalancer{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *randomBalancer) Pick(_ context.Context, servers []string) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+// roundRobinBalancer picks servers in turn.
+type roundRobinBalancer struct {
+	mu    sync.Mutex
+	index int // record the selected position for robin algorithm
+}
+
+func newRoundRobinBalancer() *roundRobinBalancer {
+	// start at a random position to avoid every client starting from 0
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &roundRobinBalancer{index: r.Intn(math.MaxInt32 - 1)}
+}
+
+func (b *roundRobinBalancer) Pick(_ context.Context, servers []string) (string, error) {
+	n := len(servers)
+	if n == 0 {
+		return "", errNoServers
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := servers[b.index%n] // servers could be updated, so mode n to ensure safety
+	b.index = (b.index + 1) % n
+	return s, nil
+}
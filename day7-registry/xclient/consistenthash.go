@@ -0,0 +1,136 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Hash maps bytes to uint32
+type Hash func(data []byte) uint32
+
+const defaultReplicas = 100
+
+// hashRing is a consistent hash ring of servers,
+// every server is placed on the ring replicas times as virtual nodes.
+type hashRing struct {
+	hash     Hash
+	replicas int
+	keys     []int // sorted
+	nodes    map[int]string
+}
+
+func newHashRing(replicas int, fn Hash, servers ...string) *hashRing {
+	m := &hashRing{
+		replicas: replicas,
+		hash:     fn,
+		nodes:    make(map[int]string),
+	}
+	if m.hash == nil {
+		m.hash = crc32.ChecksumIEEE
+	}
+	m.add(servers...)
+	return m
+}
+
+// add adds servers to the ring.
+func (m *hashRing) add(servers ...string) {
+	for _, server := range servers {
+		for i := 0; i < m.replicas; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + server)))
+			m.keys = append(m.keys, hash)
+			m.nodes[hash] = server
+		}
+	}
+	sort.Ints(m.keys)
+}
+
+// get gets the closest server on the ring for the provided key.
+func (m *hashRing) get(key string) string {
+	if len(m.keys) == 0 {
+		return ""
+	}
+	hash := int(m.hash([]byte(key)))
+	// binary search for appropriate replica.
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	return m.nodes[m.keys[idx%len(m.keys)]]
+}
+
+// consistentHashBalancer routes calls with the same hash key to the same server,
+// the ring is rebuilt whenever the server set changes.
+type consistentHashBalancer struct {
+	replicas int
+	hash     Hash
+	mu       sync.Mutex // protect following
+	servers  []string   // servers the ring was built from, sorted
+	ring     *hashRing
+}
+
+func newConsistentHashBalancer(replicas int, fn Hash) *consistentHashBalancer {
+	return &consistentHashBalancer{replicas: replicas, hash: fn}
+}
+
+func (b *consistentHashBalancer) Pick(ctx context.Context, servers []string) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	key, ok := ctx.Value(hashKeyCtxKey{}).(string)
+	if !ok {
+		return "", errors.New("rpc discovery: no hash key for consistent hash select")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ring == nil || !sameServers(b.servers, servers) {
+		b.servers = append([]string(nil), servers...)
+		sort.Strings(b.servers)
+		b.ring = newHashRing(b.replicas, b.hash, servers...)
+	}
+	return b.ring.get(key), nil
+}
+
+// sameServers reports whether servers is the same set as sorted, in any order,
+// so that the ring isn't rebuilt when discovery returns the servers shuffled.
+func sameServers(sorted, servers []string) bool {
+	if len(sorted) != len(servers) {
+		return false
+	}
+	servers = append([]string(nil), servers...)
+	sort.Strings(servers)
+	for i := range sorted {
+		if sorted[i] != servers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HashKeyer is implemented by call args that carry their own routing key
+// for ConsistentHashSelect.
+type HashKeyer interface {
+	HashKey() string
+}
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey returns a copy of ctx carrying the routing key used by ConsistentHashSelect.
+// It takes precedence over a key supplied by args.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+// withArgsHashKey attaches the hash key of args to ctx,
+// unless ctx already carries one.
+func withArgsHashKey(ctx context.Context, args interface{}) context.Context {
+	if _, ok := ctx.Value(hashKeyCtxKey{}).(string); ok {
+		return ctx
+	}
+	if k, ok := args.(HashKeyer); ok {
+		return WithHashKey(ctx, k.HashKey())
+	}
+	return ctx
+}
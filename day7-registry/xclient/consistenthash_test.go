@@ -0,0 +1,165 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"geerpc/registry"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func makeServers(n int) []string {
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("tcp@10.0.0.%d:9999", i)
+	}
+	return servers
+}
+
+func pickByKey(b Balancer, servers []string, key string) string {
+	s, _ := b.Pick(WithHashKey(context.Background(), key), servers)
+	return s
+}
+
+// movedKeys counts keys whose owner changes when servers change from before to after.
+func movedKeys(before, after []string, keys int) int {
+	b1 := newConsistentHashBalancer(defaultReplicas, nil)
+	b2 := newConsistentHashBalancer(defaultReplicas, nil)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if pickByKey(b1, before, key) != pickByKey(b2, after, key) {
+			moved++
+		}
+	}
+	return moved
+}
+
+func TestConsistentHashBalancer_Pick(t *testing.T) {
+	b := newConsistentHashBalancer(defaultReplicas, nil)
+	servers := makeServers(5)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		a, c := pickByKey(b, servers, key), pickByKey(b, servers, key)
+		_assert(a != "" && a == c, "expect the same server for %s, got %s and %s", key, a, c)
+	}
+	ring := b.ring
+	reversed := make([]string, len(servers))
+	for i, server := range servers {
+		reversed[len(servers)-1-i] = server
+	}
+	_ = pickByKey(b, reversed, "key-0")
+	_assert(b.ring == ring, "expect the ring not to be rebuilt for the same servers in another order")
+	_, err := b.Pick(context.Background(), servers)
+	_assert(err != nil, "expect an error without hash key")
+	_, err = b.Pick(WithHashKey(context.Background(), "key"), nil)
+	_assert(err != nil, "expect an error without servers")
+}
+
+func TestConsistentHash_Movement(t *testing.T) {
+	const keys = 10000
+	servers := makeServers(10)
+
+	t.Run("join", func(t *testing.T) {
+		moved := movedKeys(servers, append(servers[:10:10], "tcp@10.0.0.100:9999"), keys)
+		t.Logf("%d of %d keys moved after a server joined", moved, keys)
+		// ideally keys/11 move, allow some skew of the ring
+		_assert(moved > 0 && moved < keys*2/11, "too many keys moved: %d", moved)
+	})
+	t.Run("leave", func(t *testing.T) {
+		moved := movedKeys(servers, servers[1:], keys)
+		t.Logf("%d of %d keys moved after a server left", moved, keys)
+		// only the keys of the removed server move
+		b1 := newConsistentHashBalancer(defaultReplicas, nil)
+		b2 := newConsistentHashBalancer(defaultReplicas, nil)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			before, after := pickByKey(b1, servers, key), pickByKey(b2, servers[1:], key)
+			_assert(before == after || before == servers[0], "key %s moved from a live server", key)
+		}
+		_assert(moved < keys*2/10, "too many keys moved: %d", moved)
+	})
+}
+
+type keyedArgs struct{ Key string }
+
+func (a keyedArgs) HashKey() string { return a.Key }
+
+func TestXClient_selectServer(t *testing.T) {
+	servers := makeServers(5)
+	xc := NewXClient(NewMultiServerDiscovery(servers), ConsistentHashSelect, nil)
+	want := pickByKey(newConsistentHashBalancer(defaultReplicas, nil), servers, "user-1")
+
+	got, err := xc.selectServer(WithHashKey(context.Background(), "user-1"), "Foo.Sum", nil)
+	_assert(err == nil && got == want, "expect %s by context key, got %s", want, got)
+	got, err = xc.selectServer(context.Background(), "Foo.Sum", keyedArgs{Key: "user-1"})
+	_assert(err == nil && got == want, "expect %s by args key, got %s", want, got)
+	_, err = xc.selectServer(context.Background(), "Foo.Sum", 1)
+	_assert(err != nil, "expect an error without hash key")
+}
+
+// lastBalancer always picks the last server
+type lastBalancer struct{}
+
+func (lastBalancer) Pick(_ context.Context, servers []string) (string, error) {
+	return servers[len(servers)-1], nil
+}
+
+func TestXClient_customBalancer(t *testing.T) {
+	servers := makeServers(3)
+	xc := NewXClientWithBalancer(NewMultiServerDiscovery(servers), lastBalancer{}, nil)
+	got, err := xc.selectServer(context.Background(), "Foo.Sum", nil)
+	_assert(err == nil && got == servers[2], "expect %s, got %s", servers[2], got)
+
+	_, err = NewXClient(NewMultiServerDiscovery(servers), SelectMode(-1), nil).selectServer(context.Background(), "Foo.Sum", nil)
+	_assert(err != nil, "expect an error for unsupported select mode")
+}
+
+// staticInstances is an InstanceDiscovery with fixed metadata
+type staticInstances struct {
+	*MultiServersDiscovery
+	items map[string]registry.ServerItem
+}
+
+func (d staticInstances) Instance(rpcAddr string) (registry.ServerItem, bool) {
+	item, ok := d.items[rpcAddr]
+	return item, ok
+}
+
+func TestMetadataBalancers(t *testing.T) {
+	servers := makeServers(3)
+	d := staticInstances{NewMultiServerDiscovery(servers), map[string]registry.ServerItem{
+		servers[0]: {Addr: servers[0], Weight: 8, Zone: "a"},
+		servers[1]: {Addr: servers[1], Weight: 2, Zone: "b"},
+		servers[2]: {Addr: servers[2], Zone: "b"},
+	}}
+
+	t.Run("weighted", func(t *testing.T) {
+		b := NewWeightedBalancer(d)
+		counts := make(map[string]int)
+		for i := 0; i < 1100; i++ {
+			s, _ := b.Pick(context.Background(), servers)
+			counts[s]++
+		}
+		// expect 800 : 200 : 100
+		_assert(counts[servers[0]] > 650 && counts[servers[2]] < 200, "unexpected distribution %v", counts)
+	})
+	t.Run("prefer", func(t *testing.T) {
+		inZone := func(zone string) func(registry.ServerItem) bool {
+			return func(s registry.ServerItem) bool { return s.Zone == zone }
+		}
+		b := NewPreferBalancer(d, inZone("b"), newRoundRobinBalancer())
+		for i := 0; i < 10; i++ {
+			s, _ := b.Pick(context.Background(), servers)
+			_assert(s != servers[0], "expect servers in zone b, got %s", s)
+		}
+		b = NewPreferBalancer(d, inZone("c"), lastBalancer{})
+		s, _ := b.Pick(context.Background(), servers)
+		_assert(s == servers[2], "expect to fall back to all servers, got %s", s)
+	})
+}
@@ -1,11 +1,9 @@
 package xclient
 
 import (
-	"errors"
-	"math"
-	"math/rand"
+	"context"
+	"geerpc/registry"
 	"sync"
-	"time"
 )
 
 type SelectMode int
@@ -13,39 +11,64 @@ type SelectMode int
 const (
 	RandomSelect SelectMode = iota //select random  静态均衡算法的轮询法核随机法
 	//iota，特殊常量，可以认为是一个可以被编译器修改的常量。
-	RoundRobinSelect // select using Robbin algorithm
+	RoundRobinSelect     // select using Robbin algorithm
+	ConsistentHashSelect // select by the hash key of a call, see WithHashKey and HashKeyer
 ) //定义复数常量用括号
+
+// Discovery only maintains the server list, selecting a server
+// from it is left to a Balancer.
 type Discovery interface {
-	Refresh() error                      // refresh from remote registry从远程注册表刷新,从注册中心更新服务列表
-	Update(servers []string) error       //手动更新服务列表
-	Get(mode SelectMode) (string, error) // 根据负载均衡策略，选择一个服务实例
-	GetAll() ([]string, error)           //返回所有的服务实例
+	Refresh() error                //refresh from remote registry从远程注册表刷新,从注册中心更新服务列表
+	Update(servers []string) error //手动更新服务列表
+	GetAll() ([]string, error)     //返回所有的服务实例
+}
+
+// ModeDiscovery is a Discovery selecting a server itself, with the built-in
+// Balancer of mode. Get used to be part of Discovery, the discoveries of this
+// package still implement it, callers of Get use a ModeDiscovery instead:
+//
+//	rpcAddr, err := d.(ModeDiscovery).Get(RoundRobinSelect)
+//
+// Implementations of Discovery outside this package may keep their Get,
+// XClient ignores it and selects with its Balancer.
+type ModeDiscovery interface {
+	Discovery
+	Get(mode SelectMode) (string, error) // selects a server
+}
+
+// ServiceDiscovery is a Discovery that knows which services each server serves,
+// XClient only selects among the servers serving the service of a call.
+type ServiceDiscovery interface {
+	Discovery
+	GetService(service string) ([]string, error) // returns the servers serving service
+}
+
+// InstanceDiscovery is a Discovery that knows the metadata of each server,
+// such as weight, zone and version, it's used by metadata aware balancers.
+type InstanceDiscovery interface {
+	Discovery
+	Instance(rpcAddr string) (registry.ServerItem, bool)
 }
 
 //紧接着，我们实现一个不需要注册中心，服务列表由手工维护的服务发现的结构体：MultiServersDiscovery
 // MultiServersDiscovery is a discovery for multi servers without a registry center
 // user provides the server addresses explicitly instead  用户明确地提供服务地址
 type MultiServersDiscovery struct {
-	r       *rand.Rand   //generate random number生成随机数
-	mu      sync.RWMutex //protect following
-	servers []string     //服务序列
-	index   int          //record the selected position for robin algorithm
-	//记录robin算法的选定位置
+	mu        sync.RWMutex            //protect following
+	servers   []string                //服务序列
+	balancers map[SelectMode]Balancer // used by Get, created on demand
 }
 
 // NewMultiServerDiscovery creates a MultiServersDiscovery instance
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
-	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())), //"时间戳（毫秒）
-	} //r 是一个产生随机数的实例，初始化时使用时间戳设定随机数种子，避免每次产生相同的随机数序列。
-	d.index = d.r.Intn(math.MaxInt32 - 1)
-	//index 记录 Round Robin 算法已经轮询到的位置，为了避免每次从 0 开始，初始化时随机设定一个值。
-	return d
+	return &MultiServersDiscovery{
+		servers:   servers,
+		balancers: make(map[SelectMode]Balancer),
+	}
 }
 
 //然后，实现 Discovery 接口
-var _ Discovery = (*MultiServersDiscovery)(nil)
+var _ ModeDiscovery = (*MultiServersDiscovery)(nil)
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
 //刷新对 MultiServersDiscovery 没有意义，所以忽略它
@@ -61,23 +84,25 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.servers = servers
 	return nil
 }
+
+// Get selects a server with the built-in Balancer of mode,
+// it's a shortcut for callers not using XClient.
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
-	d.mu.Lock() //根据负载均衡策略，选择一个服务实例
-	defer d.mu.Unlock()
-	n := len(d.servers)
-	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+	servers, err := d.GetAll()
+	if err != nil {
+		return "", err
 	}
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
-		d.index = (d.index + 1) % n
-		return s, nil
-	default:
-		return "", errors.New("rpc discovery: not supported select mode")
+	d.mu.Lock()
+	b := d.balancers[mode]
+	if b == nil {
+		if b, err = NewBalancer(mode); err != nil {
+			d.mu.Unlock()
+			return "", err
+		}
+		d.balancers[mode] = b
 	}
+	d.mu.Unlock()
+	return b.Pick(context.Background(), servers)
 }
 
 // returns all servers in discovery
@@ -0,0 +1,179 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"geerpc/registry"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up DNS records, *net.Resolver implements it.
+// Replace it to resolve with another DNS client, or with a stub in tests.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// DNSOption configures a DNSDiscovery.
+type DNSOption struct {
+	Protocol string        // protocol of the servers, eg. tcp or http, "" means tcp
+	Service  string        // SRV service, eg. geerpc for _geerpc._tcp.name, "" means A/AAAA records
+	Proto    string        // SRV proto, "" means tcp
+	Port     int           // port of the servers resolved from A/AAAA records
+	Interval time.Duration // time between two lookups
+	Timeout  time.Duration // timeout of a lookup
+	Resolver Resolver      // nil means net.DefaultResolver
+}
+
+var DefaultDNSOption = &DNSOption{
+	Protocol: "tcp",
+	Proto:    "tcp",
+	Interval: time.Second * 30,
+	Timeout:  time.Second * 5,
+}
+
+// DNSDiscovery resolves the servers from the DNS records of a name on an interval:
+// SRV records give the host and port of every server, A/AAAA records give
+// the addresses of servers listening on the same port.
+// Only the SRV records of the lowest priority are used, the others are backups
+// not used until those records are removed. Their weights are kept, see Instance.
+type DNSDiscovery struct {
+	*MultiServersDiscovery
+	name       string
+	opt        DNSOption
+	lastUpdate time.Time                      // protected by mu
+	instances  map[string]registry.ServerItem // protected by mu
+}
+
+var _ InstanceDiscovery = (*DNSDiscovery)(nil)
+var _ ModeDiscovery = (*DNSDiscovery)(nil)
+
+// NewDNSDiscovery creates a discovery of the servers of name, nil opt means DefaultDNSOption.
+// The first lookup is done on the first call.
+func NewDNSDiscovery(name string, opt *DNSOption) (*DNSDiscovery, error) {
+	if opt == nil {
+		opt = DefaultDNSOption
+	}
+	d := &DNSDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		name:                  name,
+		opt:                   *opt,
+		instances:             make(map[string]registry.ServerItem),
+	}
+	if d.opt.Protocol == "" {
+		d.opt.Protocol = DefaultDNSOption.Protocol
+	}
+	if d.opt.Proto == "" {
+		d.opt.Proto = DefaultDNSOption.Proto
+	}
+	if d.opt.Interval <= 0 {
+		d.opt.Interval = DefaultDNSOption.Interval
+	}
+	if d.opt.Timeout <= 0 {
+		d.opt.Timeout = DefaultDNSOption.Timeout
+	}
+	if d.opt.Resolver == nil {
+		d.opt.Resolver = net.DefaultResolver
+	}
+	if d.opt.Service == "" && d.opt.Port <= 0 {
+		return nil, errors.New("rpc discovery: port required to resolve A records of " + name)
+	}
+	return d, nil
+}
+
+// Refresh resolves the servers again once the interval is over. A failed lookup
+// keeps the last servers resolved, if any, until the next interval.
+func (d *DNSDiscovery) Refresh() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastUpdate.Add(d.opt.Interval).After(time.Now()) {
+		return nil
+	}
+	resolved := !d.lastUpdate.IsZero()
+	instances, err := d.lookup()
+	if err != nil {
+		if !resolved {
+			return err
+		}
+		log.Println("rpc discovery: resolve", d.name, "err:", err)
+		d.lastUpdate = time.Now()
+		return nil
+	}
+	servers := make([]string, 0, len(instances))
+	d.instances = make(map[string]registry.ServerItem, len(instances))
+	for _, item := range instances {
+		servers = append(servers, item.Addr)
+		d.instances[item.Addr] = item
+	}
+	d.servers = servers
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+// lookup resolves the servers sorted by address.
+func (d *DNSDiscovery) lookup() ([]registry.ServerItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.Timeout)
+	defer cancel()
+	var instances []registry.ServerItem
+	if d.opt.Service != "" {
+		_, records, err := d.opt.Resolver.LookupSRV(ctx, d.opt.Service, d.opt.Proto, d.name)
+		if err != nil {
+			return nil, err
+		}
+		var priority uint16
+		for i, srv := range records {
+			if i == 0 || srv.Priority < priority {
+				priority = srv.Priority
+			}
+		}
+		for _, srv := range records {
+			if srv.Priority != priority {
+				continue
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			instances = append(instances, registry.ServerItem{
+				Addr:   d.opt.Protocol + "@" + net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+				Weight: int(srv.Weight),
+			})
+		}
+	} else {
+		hosts, err := d.opt.Resolver.LookupHost(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			instances = append(instances, registry.ServerItem{
+				Addr: d.opt.Protocol + "@" + net.JoinHostPort(host, strconv.Itoa(d.opt.Port)),
+			})
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Addr < instances[j].Addr })
+	return instances, nil
+}
+
+// Instance returns the server resolved at rpcAddr, with the weight of its SRV record.
+func (d *DNSDiscovery) Instance(rpcAddr string) (registry.ServerItem, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	item, ok := d.instances[rpcAddr]
+	return item, ok
+}
+
+func (d *DNSDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+func (d *DNSDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
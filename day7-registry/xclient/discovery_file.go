@@ -0,0 +1,220 @@
+package xclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileDiscovery reads the servers from a file, and reloads it when its
+// modification time changes. The file is a list of protocol@addr, as json:
+//
+//	["tcp@10.0.0.1:9999", "tcp@10.0.0.2:9999"]
+//
+// or as yaml:
+//
+//	servers:
+//	  - tcp@10.0.0.1:9999
+//	  - tcp@10.0.0.2:9999
+//
+// the list may be at the top level or under "servers" in both formats.
+// Files ending with .json are json, .yaml and .yml are yaml, others are
+// json if they start with [ or {.
+// Only a line-based subset of yaml is supported, not yaml in general: one
+// server per "- " line, or a flow list on a single line, eg. servers: [a, b],
+// with comments and quoted servers, see parseYAMLList.
+//
+// The servers are those of the file only, Update fails.
+type FileDiscovery struct {
+	*MultiServersDiscovery
+	path      string
+	interval  time.Duration
+	modTime   time.Time // protected by mu
+	lastCheck time.Time // protected by mu
+}
+
+var _ ModeDiscovery = (*FileDiscovery)(nil)
+
+const defaultFileCheckInterval = time.Second
+
+// NewFileDiscovery loads the servers in path, the modification time of the
+// file is checked at most once every interval, 0 means 1s.
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = defaultFileCheckInterval
+	}
+	d := &FileDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		path:                  path,
+		interval:              interval,
+	}
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Refresh reloads the file if it changed since the last load. The servers
+// are kept if the file is invalid, eg. while it's being written, and it's
+// loaded again on the next check.
+func (d *FileDiscovery) Refresh() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.lastCheck.IsZero() && d.lastCheck.Add(d.interval).After(time.Now()) {
+		return nil
+	}
+	d.lastCheck = time.Now()
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(d.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	servers, err := parseServerList(data, filepath.Ext(d.path))
+	if err != nil {
+		return fmt.Errorf("rpc discovery: invalid server list %s: %v", d.path, err)
+	}
+	log.Printf("rpc discovery: loaded %d servers from %s", len(servers), d.path)
+	d.servers = servers
+	d.modTime = fi.ModTime()
+	return nil
+}
+
+var errFileDiscoveryUpdate = errors.New("rpc discovery: servers of a file discovery are updated by writing the file")
+
+// Update fails, the servers would be replaced on the next reload of the file.
+func (d *FileDiscovery) Update(servers []string) error {
+	return errFileDiscoveryUpdate
+}
+
+// Get and GetAll keep using the last servers loaded if the file can't be reloaded.
+func (d *FileDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		log.Println("rpc discovery: reload err:", err)
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+func (d *FileDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		log.Println("rpc discovery: reload err:", err)
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+// parseServerList parses a list of protocol@addr as json or yaml, ext is the file extension.
+func parseServerList(data []byte, ext string) ([]string, error) {
+	var servers []string
+	var err error
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case ext == ".json", ext != ".yaml" && ext != ".yml" && (bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("{"))):
+		servers, err = parseJSONList(trimmed)
+	default:
+		servers, err = parseYAMLList(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		if !strings.Contains(server, "@") {
+			return nil, fmt.Errorf("server %q should be protocol@addr", server)
+		}
+	}
+	return servers, nil
+}
+
+func parseJSONList(data []byte) ([]string, error) {
+	servers := make([]string, 0)
+	if bytes.HasPrefix(data, []byte("{")) {
+		var v struct {
+			Servers []string `json:"servers"`
+		}
+		err := json.Unmarshal(data, &v)
+		if v.Servers != nil {
+			servers = v.Servers
+		}
+		return servers, err
+	}
+	err := json.Unmarshal(data, &servers)
+	return servers, err
+}
+
+// parseYAMLList parses the small, line-based subset of yaml used by server
+// lists: a sequence of scalars, at the top level or under a "servers" key,
+// either one "- server" per line or a flow sequence on a single line, eg.
+// [a, b] or servers: [], with comments and quoted scalars.
+// Anything else is rejected, eg. other keys or a flow sequence spanning lines.
+func parseYAMLList(data []byte) ([]string, error) {
+	servers := make([]string, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		if c := strings.Index(line, " #"); c >= 0 {
+			line = line[:c]
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "servers:") && line != "servers:" {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "servers:"))
+			if !strings.HasPrefix(line, "[") {
+				return nil, fmt.Errorf("line %d: unsupported yaml %q", i+1, line)
+			}
+		}
+		switch {
+		case line == "" || line == "---" || strings.HasPrefix(line, "#"):
+		case line == "servers:":
+		case line == "-" || strings.HasPrefix(line, "- "):
+			v, err := yamlScalar(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			servers = append(servers, v)
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			items := strings.TrimSpace(line[1 : len(line)-1])
+			if items == "" {
+				continue
+			}
+			// quoted servers containing a comma are not supported
+			for _, item := range strings.Split(items, ",") {
+				v, err := yamlScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				servers = append(servers, v)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unsupported yaml %q", i+1, line)
+		}
+	}
+	return servers, nil
+}
+
+// yamlScalar returns the value of a plain or quoted yaml scalar.
+func yamlScalar(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		if v[0] == '"' {
+			s, err := strconv.Unquote(v)
+			if err != nil {
+				return "", err
+			}
+			v = s
+		} else {
+			v = strings.ReplaceAll(v[1:len(v)-1], "''", "'")
+		}
+	}
+	if v == "" {
+		return "", errors.New("empty server")
+	}
+	return v, nil
+}
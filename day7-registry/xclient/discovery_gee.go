@@ -1,9 +1,11 @@
 package xclient
 
 import (
+	"encoding/json"
+	"fmt"
+	"geerpc/registry"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -11,61 +13,193 @@ import (
 type GeeRegistryDiscovery struct {
 	*MultiServersDiscovery
 	registry   string
+	endpoints  *registry.Endpoints
+	client     *http.Client
+	scope      registry.Scope
 	timeout    time.Duration
 	lastUpdate time.Time
+	updated    bool                           // servers were set by Update, protected by mu
+	services   map[string]*serviceServers     // servers per service, protected by mu
+	instances  map[string]registry.ServerItem // metadata of servers, protected by mu
 }
 
-const defaultUpdateTimeout = time.Second * 10
+var _ ModeDiscovery = (*GeeRegistryDiscovery)(nil)
 
-func NewGeeRegistryDiscovery(registerAddr string, timeout time.Duration) *GeeRegistryDiscovery {
+// serviceServers caches the servers of a service fetched from registry
+type serviceServers struct {
+	servers    []string
+	lastUpdate time.Time
+}
+
+const (
+	defaultUpdateTimeout = time.Second * 10
+	defaultFetchTimeout  = time.Second * 5 // max time to fetch the servers from a registry node
+)
+
+// NewGeeRegistryDiscovery creates a discovery of the servers registered to registerAddr,
+// in the namespace of scope if given, see registry.Scope.
+func NewGeeRegistryDiscovery(registerAddr string, timeout time.Duration, scope ...registry.Scope) *GeeRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
 	d := &GeeRegistryDiscovery{
 		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:              registerAddr,
+		endpoints:             registry.NewEndpoints(registerAddr),
+		client:                &http.Client{Timeout: defaultFetchTimeout},
+		scope:                 scopeOf(scope),
 		timeout:               timeout,
+		services:              make(map[string]*serviceServers),
+		instances:             make(map[string]registry.ServerItem),
 	}
 	return d
 }
 
+func scopeOf(scope []registry.Scope) registry.Scope {
+	if len(scope) == 0 {
+		return registry.Scope{}
+	}
+	return scope[0]
+}
+
 //GeeRegistryDiscovery 嵌套了 MultiServersDiscovery，很多能力可以复用。
 //registry 即注册中心的地址
 //timeout 服务列表的过期时间
 //lastUpdate 是代表最后从注册中心更新服务列表的时间，默认 10s 过期
 //，即 10s 之后，需要从注册中心更新新的列表。
 //实现 Update 和 Refresh 方法，超时重新获取的逻辑在 Refresh 中实现：
+// Update sets the servers until they expire, they are used by GetService
+// too, in place of the servers of each service cached so far.
 func (d *GeeRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.servers = servers
 	d.lastUpdate = time.Now() //lastUpdate 是代表最后从注册中心更新服务列表的时间
 	//对最后从注册中心更新服务列表的时间的更新
+	d.updated = true
+	d.services = make(map[string]*serviceServers)
 	return nil
 }
+
+// Refresh fetches the servers from registry once they expired. The servers
+// and their metadata are kept if the fetch fails. The fetch is done without
+// holding d.mu, so that a slow registry doesn't block the other calls.
 func (d *GeeRegistryDiscovery) Refresh() error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+	d.mu.RLock()
+	fresh := d.lastUpdate.Add(d.timeout).After(time.Now())
+	d.mu.RUnlock()
+	if fresh {
 		return nil
 	}
 	log.Println("rpc registry:refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	start := time.Now()
+	items, err := d.fetch("")
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
 		return err
 	}
-	servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
-		}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastUpdate.After(start) { // updated meanwhile, by Update or another Refresh
+		return nil
+	}
+	// forget servers gone
+	d.instances = make(map[string]registry.ServerItem, len(items))
+	d.servers = make([]string, 0, len(items))
+	for _, item := range items {
+		d.servers = append(d.servers, item.Addr)
+		d.instances[item.Addr] = item
 	}
 	d.lastUpdate = time.Now()
+	d.updated = false
+	d.services = make(map[string]*serviceServers)
 	return nil
 }
 
+// fetch gets the alive servers serving service from registry, empty service means all.
+func (d *GeeRegistryDiscovery) fetch(service string) (items []registry.ServerItem, err error) {
+	err = d.endpoints.Do(func(registryAddr string) error {
+		items, err = d.fetchFrom(registryAddr, service)
+		return err
+	})
+	return
+}
+
+func (d *GeeRegistryDiscovery) fetchFrom(registryAddr, service string) ([]registry.ServerItem, error) {
+	addr := registryAddr + "/v1/instances"
+	q := d.scope.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	if len(q) > 0 {
+		addr += "?" + q.Encode()
+	}
+	req, _ := http.NewRequest("GET", addr, nil)
+	d.scope.SetHeader(req.Header)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		log.Println("rpc registry refresh err:", err)
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rpc registry: refresh status %s", resp.Status)
+		log.Println("rpc registry refresh err:", err)
+		return nil, err
+	}
+	var items []registry.ServerItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		log.Println("rpc registry refresh err:", err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// Instance returns the metadata of rpcAddr last fetched from registry.
+func (d *GeeRegistryDiscovery) Instance(rpcAddr string) (registry.ServerItem, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	item, ok := d.instances[rpcAddr]
+	return item, ok
+}
+
+// GetService returns the servers serving service, the list of
+// each service is cached and refreshed like the list of all servers.
+// The servers set by Update are used instead until they expire, minus
+// the ones known not to serve service.
+func (d *GeeRegistryDiscovery) GetService(service string) ([]string, error) {
+	d.mu.RLock()
+	if d.updated && d.lastUpdate.Add(d.timeout).After(time.Now()) {
+		servers := make([]string, 0, len(d.servers))
+		for _, rpcAddr := range d.servers {
+			if item, ok := d.instances[rpcAddr]; !ok || item.Serves(service) {
+				servers = append(servers, rpcAddr)
+			}
+		}
+		d.mu.RUnlock()
+		return servers, nil
+	}
+	s := d.services[service]
+	d.mu.RUnlock()
+	if s == nil || s.lastUpdate.Add(d.timeout).Before(time.Now()) {
+		// fetch without holding d.mu, like Refresh
+		items, err := d.fetch(service)
+		if err != nil {
+			return nil, err
+		}
+		s = &serviceServers{servers: make([]string, 0, len(items)), lastUpdate: time.Now()}
+		d.mu.Lock()
+		for _, item := range items {
+			s.servers = append(s.servers, item.Addr)
+			d.instances[item.Addr] = item
+		}
+		d.services[service] = s
+		d.mu.Unlock()
+	}
+	servers := make([]string, len(s.servers))
+	copy(servers, s.servers)
+	return servers, nil
+}
+
 //Get 和 GetAll 与 MultiServersDiscovery 相似，唯一的不同在于
 //，GeeRegistryDiscovery 需要先调用 Refresh 确保服务列表没有过期。
 func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
@@ -0,0 +1,160 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseServerList(t *testing.T) {
+	cases := []struct {
+		ext, data string
+		want      string
+	}{
+		{".json", `["tcp@a:1", "tcp@b:1"]`, "tcp@a:1,tcp@b:1"},
+		{"", `{"servers": ["tcp@a:1"]}`, "tcp@a:1"},
+		{".yaml", "servers:\n  - tcp@a:1 # first\n  - \"tcp@b:1\"\n", "tcp@a:1,tcp@b:1"},
+		{".yml", "# servers\n---\n- 'unix@/tmp/a.sock'\n", "unix@/tmp/a.sock"},
+		{".yaml", "servers: [tcp@a:1, 'tcp@b:1'] # flow\n", "tcp@a:1,tcp@b:1"},
+		{".yaml", "  servers: []\n", ""},
+		{".yml", "[\"tcp@a:1\"]\n", "tcp@a:1"},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		servers, err := parseServerList([]byte(c.data), c.ext)
+		_assert(err == nil && strings.Join(servers, ",") == c.want, "%q: expect %s, got %v %v", c.data, c.want, servers, err)
+	}
+	for _, data := range []string{`["a:1"]`, "servers:\n  port: 1\n", `[1]`, "servers: tcp@a:1\n", "servers: [tcp@a:1,\n  tcp@b:1]\n", "[tcp@a:1, ]\n"} {
+		_, err := parseServerList([]byte(data), "")
+		_assert(err != nil, "expect %q to be invalid", data)
+	}
+}
+
+func TestModeDiscovery(t *testing.T) {
+	servers := makeServers(3)
+	var d Discovery = NewMultiServerDiscovery(servers)
+	md, ok := d.(ModeDiscovery)
+	_assert(ok, "expect the discovery to select servers itself")
+	first, _ := md.Get(RoundRobinSelect)
+	second, _ := md.Get(RoundRobinSelect)
+	_assert(first != second, "expect round robin, got %s twice", first)
+	_, err := md.Get(ConsistentHashSelect)
+	_assert(err != nil, "expect consistent hash to fail without a key")
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.yaml")
+	_assert(os.WriteFile(path, []byte("- tcp@a:1\n- tcp@b:1\n"), 0o644) == nil, "failed to write servers")
+	_, err := NewFileDiscovery(path+".missing", 0)
+	_assert(err != nil, "expect a missing file to fail")
+	d, err := NewFileDiscovery(path, time.Millisecond)
+	_assert(err == nil, "failed to load servers: %v", err)
+	all, _ := d.GetAll()
+	_assert(strings.Join(all, ",") == "tcp@a:1,tcp@b:1", "expect servers of the file, got %v", all)
+	_assert(d.Update([]string{"tcp@z:1"}) != nil, "expect Update to fail")
+	all, _ = d.GetAll()
+	_assert(strings.Join(all, ",") == "tcp@a:1,tcp@b:1", "expect servers not to be updated, got %v", all)
+
+	// reloaded once the modification time changes
+	_assert(os.WriteFile(path, []byte("- tcp@c:1\n"), 0o644) == nil, "failed to write servers")
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, later, later)
+	time.Sleep(time.Millisecond * 5)
+	all, _ = d.GetAll()
+	_assert(strings.Join(all, ",") == "tcp@c:1", "expect servers to be reloaded, got %v", all)
+
+	// an invalid file keeps the last servers
+	_assert(os.WriteFile(path, []byte("servers: [\n"), 0o644) == nil, "failed to write servers")
+	later = later.Add(time.Second)
+	_ = os.Chtimes(path, later, later)
+	time.Sleep(time.Millisecond * 5)
+	_assert(d.Refresh() != nil, "expect an invalid file to fail")
+	all, _ = d.GetAll()
+	_assert(strings.Join(all, ",") == "tcp@c:1", "expect the last servers to be kept, got %v", all)
+}
+
+// stubResolver is an in-process DNS serving fixed records.
+type stubResolver struct {
+	mu      sync.Mutex
+	srv     map[string][]*net.SRV
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	cname := "_" + service + "._" + proto + "." + name
+	records, ok := r.srv[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func (r *stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) set(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	stub := &stubResolver{
+		srv: map[string][]*net.SRV{"_geerpc._tcp.foo.local": {
+			{Target: "b.foo.local.", Port: 9999, Priority: 10, Weight: 1},
+			{Target: "a.foo.local.", Port: 9999, Priority: 10, Weight: 3},
+			{Target: "backup.foo.local.", Port: 9999, Priority: 20},
+		}},
+		hosts: map[string][]string{"foo.local": {"10.0.0.2", "10.0.0.1", "::1"}},
+	}
+	_, err := NewDNSDiscovery("foo.local", &DNSOption{Resolver: stub})
+	_assert(err != nil, "expect a port to be required for A records")
+
+	d, _ := NewDNSDiscovery("foo.local", &DNSOption{Service: "geerpc", Resolver: stub, Interval: time.Millisecond * 50})
+	all, err := d.GetAll()
+	_assert(err == nil && strings.Join(all, ",") == "tcp@a.foo.local:9999,tcp@b.foo.local:9999",
+		"expect the SRV records of the lowest priority, got %v %v", all, err)
+	item, _ := d.Instance("tcp@a.foo.local:9999")
+	_assert(item.Weight == 3, "expect the weight of the SRV record, got %+v", item)
+
+	// resolved again after the interval, a failure keeps the last servers
+	stub.set(func() { stub.srv = nil })
+	all, _ = d.GetAll()
+	_assert(len(all) == 2 && stub.lookups == 1, "expect no lookup before the interval")
+	time.Sleep(time.Millisecond * 60)
+	all, err = d.GetAll()
+	_assert(err == nil && len(all) == 2 && stub.lookups == 2, "expect the last servers on failure, got %v %v", all, err)
+	stub.set(func() {
+		stub.srv = map[string][]*net.SRV{"_geerpc._tcp.foo.local": {{Target: "backup.foo.local.", Port: 9999, Priority: 20}}}
+	})
+	time.Sleep(time.Millisecond * 60)
+	all, _ = d.GetAll()
+	_assert(strings.Join(all, ",") == "tcp@backup.foo.local:9999", "expect the backup records, got %v", all)
+
+	a, _ := NewDNSDiscovery("foo.local", &DNSOption{Protocol: "http", Port: 9999, Resolver: stub})
+	all, err = a.GetAll()
+	_assert(err == nil && strings.Join(all, ",") == "http@10.0.0.1:9999,http@10.0.0.2:9999,http@[::1]:9999",
+		"expect the A records, got %v %v", all, err)
+	missing, _ := NewDNSDiscovery("bar.local", &DNSOption{Port: 9999, Resolver: stub})
+	_, err = missing.GetAll()
+	var dnsErr *net.DNSError
+	_assert(errors.As(err, &dnsErr) && dnsErr.IsNotFound, "expect the first failed lookup to fail, got %v", err)
+}
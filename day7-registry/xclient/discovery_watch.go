@@ -0,0 +1,315 @@
+package xclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "geerpc"
+	"geerpc/registry"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GeeRegistryWatchDiscovery keeps a watch open on a GeeRegistry, changes of
+// the registry are applied as soon as they happen instead of on the next
+// refresh after a timeout like GeeRegistryDiscovery.
+// The registry is watched over http, or over geerpc, see NewGeeRegistryRPCDiscovery.
+type GeeRegistryWatchDiscovery struct {
+	*MultiServersDiscovery
+	endpoints *registry.Endpoints
+	scope     registry.Scope
+	wait      time.Duration
+	watchFrom func(ctx context.Context, addr string, index uint64) ([]registry.ServerItem, uint64, error)
+	client    *http.Client
+	opt       *Option
+	clients   map[string]*Client             // geerpc clients of the registries, protected by mu
+	index     uint64                         // revision of the registry last applied, protected by mu
+	instances map[string]registry.ServerItem // protected by mu
+	err       error                          // error of the last watch, protected by mu
+	synced    chan struct{}                  // closed once the servers are fetched
+	syncOnce  sync.Once
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+const (
+	defaultWatchWait  = time.Second * 30
+	watchRetryBackoff = time.Second
+)
+
+var errNotSynced = errors.New("rpc discovery: servers not fetched from registry yet")
+
+var _ InstanceDiscovery = (*GeeRegistryWatchDiscovery)(nil)
+var _ ServiceDiscovery = (*GeeRegistryWatchDiscovery)(nil)
+var _ ModeDiscovery = (*GeeRegistryWatchDiscovery)(nil)
+
+// NewGeeRegistryWatchDiscovery creates a discovery watching registerAddr, every
+// watch request waits for changes up to wait, 0 means 30s.
+// It watches the namespace of scope if given, see registry.Scope.
+// Close it to stop the watch.
+func NewGeeRegistryWatchDiscovery(registerAddr string, wait time.Duration, scope ...registry.Scope) *GeeRegistryWatchDiscovery {
+	d := newWatchDiscovery(registerAddr, wait, scopeOf(scope))
+	d.client = &http.Client{}
+	d.watchFrom = d.watchHTTP
+	d.start()
+	return d
+}
+
+// NewGeeRegistryRPCDiscovery is like NewGeeRegistryWatchDiscovery, but watches
+// the geerpc service of a registry, see registry.Registry. rpcAddr is dialed
+// with XDial, eg. tcp@10.0.0.1:9999, a comma separated list fails over.
+// The server must handle requests longer than wait.
+func NewGeeRegistryRPCDiscovery(rpcAddr string, wait time.Duration, opt *Option, scope ...registry.Scope) *GeeRegistryWatchDiscovery {
+	d := newWatchDiscovery(rpcAddr, wait, scopeOf(scope))
+	d.opt = opt
+	d.clients = make(map[string]*Client)
+	d.watchFrom = d.watchRPC
+	d.start()
+	return d
+}
+
+func newWatchDiscovery(registerAddr string, wait time.Duration, scope registry.Scope) *GeeRegistryWatchDiscovery {
+	if wait <= 0 {
+		wait = defaultWatchWait
+	}
+	return &GeeRegistryWatchDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		endpoints:             registry.NewEndpoints(registerAddr),
+		scope:                 scope,
+		wait:                  wait,
+		instances:             make(map[string]registry.ServerItem),
+		synced:                make(chan struct{}),
+		done:                  make(chan struct{}),
+	}
+}
+
+func (d *GeeRegistryWatchDiscovery) start() {
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	go d.run(ctx)
+}
+
+func (d *GeeRegistryWatchDiscovery) run(ctx context.Context) {
+	defer close(d.done)
+	var index uint64
+	for {
+		items, next, err := d.watch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		d.mu.Lock()
+		d.err = err
+		d.mu.Unlock()
+		if err != nil {
+			log.Println("rpc registry watch err:", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryBackoff):
+			}
+			continue
+		}
+		if next != index || !d.isSynced() {
+			d.apply(items, next)
+		}
+		index = next
+	}
+}
+
+// watch waits for the registry to move from index, and returns the alive servers and the new index.
+// The nodes of a cluster have their own index, a watch failing over to
+// another node returns at once with the index of that node.
+func (d *GeeRegistryWatchDiscovery) watch(ctx context.Context, index uint64) (items []registry.ServerItem, next uint64, err error) {
+	err = d.endpoints.Do(func(registryAddr string) error {
+		items, next, err = d.watchFrom(ctx, registryAddr, index)
+		return err
+	})
+	return
+}
+
+func (d *GeeRegistryWatchDiscovery) watchHTTP(ctx context.Context, registryAddr string, index uint64) ([]registry.ServerItem, uint64, error) {
+	q := d.scope.Query()
+	if d.isSynced() {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", d.wait.String())
+	}
+	addr := registryAddr + "/v1/instances"
+	if len(q) > 0 {
+		addr += "?" + q.Encode()
+	}
+	// give up if the registry doesn't answer in time, eg. the connection is broken
+	ctx, cancel := context.WithTimeout(ctx, d.wait+defaultUpdateTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	d.scope.SetHeader(req.Header)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("rpc registry: watch status %s", resp.Status)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Geerpc-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rpc registry: invalid watch index %q", resp.Header.Get("X-Geerpc-Index"))
+	}
+	var items []registry.ServerItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, 0, err
+	}
+	return items, next, nil
+}
+
+func (d *GeeRegistryWatchDiscovery) apply(items []registry.ServerItem, index uint64) {
+	servers := make([]string, 0, len(items))
+	instances := make(map[string]registry.ServerItem, len(items))
+	for _, item := range items {
+		servers = append(servers, item.Addr)
+		instances[item.Addr] = item
+	}
+	d.mu.Lock()
+	d.servers = servers
+	d.instances = instances
+	d.index = index
+	d.mu.Unlock()
+	d.syncOnce.Do(func() { close(d.synced) })
+}
+
+func (d *GeeRegistryWatchDiscovery) isSynced() bool {
+	select {
+	case <-d.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// Refresh waits for the servers to be fetched for the first time,
+// later changes are applied by the watch.
+func (d *GeeRegistryWatchDiscovery) Refresh() error {
+	if d.isSynced() {
+		return nil
+	}
+	d.mu.RLock()
+	err := d.err
+	d.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	t := time.NewTimer(defaultUpdateTimeout)
+	defer t.Stop()
+	select {
+	case <-d.synced:
+		return nil
+	case <-d.done:
+	case <-t.C:
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.err != nil {
+		return d.err
+	}
+	return errNotSynced
+}
+
+func (d *GeeRegistryWatchDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+func (d *GeeRegistryWatchDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+// GetService returns the servers serving service, filtered locally from the watched servers.
+func (d *GeeRegistryWatchDiscovery) GetService(service string) ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	servers := make([]string, 0, len(d.servers))
+	for _, rpcAddr := range d.servers {
+		if item, ok := d.instances[rpcAddr]; !ok || item.Serves(service) {
+			servers = append(servers, rpcAddr)
+		}
+	}
+	return servers, nil
+}
+
+// Instance returns the metadata of rpcAddr last applied from the registry.
+func (d *GeeRegistryWatchDiscovery) Instance(rpcAddr string) (registry.ServerItem, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	item, ok := d.instances[rpcAddr]
+	return item, ok
+}
+
+// Index returns the revision of the registry last applied.
+func (d *GeeRegistryWatchDiscovery) Index() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.index
+}
+
+func (d *GeeRegistryWatchDiscovery) watchRPC(ctx context.Context, rpcAddr string, index uint64) ([]registry.ServerItem, uint64, error) {
+	client, err := d.rpcClient(rpcAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	method := "Registry.Watch"
+	if !d.isSynced() {
+		method = "Registry.List"
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.wait+defaultUpdateTimeout)
+	defer cancel()
+	var reply registry.ListReply
+	args := registry.ListArgs{Namespace: d.scope.Namespace, Index: index, Wait: d.wait, Token: d.scope.Token}
+	if err := client.Call(ctx, method, args, &reply); err != nil {
+		return nil, 0, err
+	}
+	return reply.Servers, reply.Index, nil
+}
+
+// rpcClient returns the cached client of rpcAddr, or dials it.
+func (d *GeeRegistryWatchDiscovery) rpcClient(rpcAddr string) (*Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	client := d.clients[rpcAddr]
+	if client != nil && client.IsAvailable() {
+		return client, nil
+	}
+	if client != nil {
+		_ = client.Close()
+	}
+	client, err := XDial(rpcAddr, d.opt)
+	if err != nil {
+		delete(d.clients, rpcAddr)
+		return nil, err
+	}
+	d.clients[rpcAddr] = client
+	return client, nil
+}
+
+// Close stops the watch.
+func (d *GeeRegistryWatchDiscovery) Close() error {
+	d.cancel()
+	<-d.done
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for rpcAddr, client := range d.clients {
+		_ = client.Close()
+		delete(d.clients, rpcAddr)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// GatherMode decides when a scatter-gather call is complete.
+type GatherMode int
+
+const (
+	GatherAll        GatherMode = iota // all servers must succeed, fail fast on the first error
+	GatherFirstN                       // complete as soon as n servers succeed
+	GatherBestEffort                   // wait for every server until ctx is done, fail only if none succeeds
+)
+
+// CallResult is the reply or error of a single server.
+type CallResult struct {
+	Reply interface{}
+	Error error
+}
+
+var errGatherCanceled = errors.New("rpc xclient: call canceled, gather is complete")
+
+// Gather sends the request to every healthy server of the service in parallel and returns
+// the result of each one, keyed by server address. reply is only used as a prototype,
+// each server gets its own copy of it. n is the number of successes GatherFirstN waits for.
+// Calls still running when the gather completes are canceled and reported as errors.
+func (xc *XClient) Gather(ctx context.Context, serviceMethod string, args, reply interface{},
+	mode GatherMode, n int) (map[string]*CallResult, error) {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	return xc.gather(ctx, servers, serviceMethod, args, reply, mode, n)
+}
+
+func (xc *XClient) gather(ctx context.Context, servers []string, serviceMethod string, args, reply interface{},
+	mode GatherMode, n int) (map[string]*CallResult, error) {
+	if len(servers) == 0 {
+		return nil, errNoServers
+	}
+	if mode == GatherFirstN && (n <= 0 || n > len(servers)) {
+		return nil, fmt.Errorf("rpc xclient: can't gather %d successes from %d servers", n, len(servers))
+	}
+
+	type result struct {
+		rpcAddr string
+		*CallResult
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancel unfinished calls once gather is complete
+	ch := make(chan result, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			clonedReply := cloneReply(reply)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			ch <- result{rpcAddr, &CallResult{Reply: clonedReply, Error: err}}
+		}(rpcAddr)
+	}
+
+	results := make(map[string]*CallResult, len(servers))
+	var firstErr error
+	succeeded := 0
+	abort := errGatherCanceled
+loop:
+	for received := 0; received < len(servers); received++ {
+		select {
+		case <-ctx.Done():
+			abort = errors.New("rpc xclient: call failed: " + ctx.Err().Error())
+			break loop
+		case r := <-ch:
+			results[r.rpcAddr] = r.CallResult
+			if r.Error != nil {
+				if firstErr == nil {
+					firstErr = r.Error
+				}
+				if mode == GatherAll {
+					break loop
+				}
+				continue
+			}
+			succeeded++
+			if mode == GatherFirstN && succeeded == n {
+				break loop
+			}
+		}
+	}
+	for _, rpcAddr := range servers {
+		if _, ok := results[rpcAddr]; !ok {
+			results[rpcAddr] = &CallResult{Error: abort}
+		}
+	}
+
+	switch {
+	case mode == GatherAll && succeeded < len(servers):
+		if firstErr == nil {
+			firstErr = abort
+		}
+		return results, firstErr
+	case mode == GatherFirstN && succeeded < n:
+		return results, fmt.Errorf("rpc xclient: only %d of %d required servers succeeded", succeeded, n)
+	case mode == GatherBestEffort && succeeded == 0:
+		if firstErr == nil {
+			firstErr = abort
+		}
+		return results, firstErr
+	}
+	return results, nil
+}
+
+// Fork sends the request to n servers chosen by the balancer in parallel,
+// and returns as soon as any of them succeeds, canceling the others.
+// n <= 0 means all servers. It fails only if all of them fail,
+// the error is a ServerErrors then.
+// Every server but the first is counted in the fan-out of the client metrics.
+func (xc *XClient) Fork(ctx context.Context, serviceMethod string, args, reply interface{}, n int) error {
+	servers, err := xc.selectServers(ctx, serviceMethod, args, n)
+	if err != nil {
+		return err
+	}
+	xc.metrics().RecordFanout(serviceMethod, len(servers)-1)
+	results, err := xc.gather(ctx, servers, serviceMethod, args, reply, GatherFirstN, 1)
+	if err != nil && results == nil {
+		return err
+	}
+	if err != nil {
+		errs := make(ServerErrors, len(results))
+		for rpcAddr, r := range results {
+			errs[rpcAddr] = r.Error
+		}
+		return errs
+	}
+	for _, r := range results {
+		if r.Error == nil && reply != nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.Reply).Elem())
+			break
+		}
+	}
+	return nil
+}
+
+// selectServers lets the balancer pick n distinct servers one by one.
+func (xc *XClient) selectServers(ctx context.Context, serviceMethod string, args interface{}, n int) ([]string, error) {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 || n >= len(servers) {
+		return servers, nil
+	}
+	ctx = withArgsHashKey(ctx, args)
+	rest := append([]string(nil), servers...)
+	picked := make([]string, 0, n)
+	for len(picked) < n {
+		rpcAddr, err := xc.b.Pick(ctx, rest)
+		if err != nil {
+			return nil, err
+		}
+		picked = append(picked, rpcAddr)
+		for i := range rest {
+			if rest[i] == rpcAddr {
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+	}
+	return picked, nil
+}
+
+// ServerErrors is the aggregated error of calls to multiple servers,
+// keyed by server address.
+type ServerErrors map[string]error
+
+func (e ServerErrors) Error() string {
+	addrs := make([]string, 0, len(e))
+	for rpcAddr := range e {
+		addrs = append(addrs, rpcAddr)
+	}
+	sort.Strings(addrs)
+	msgs := make([]string, len(addrs))
+	for i, rpcAddr := range addrs {
+		msgs[i] = rpcAddr + ": " + e[rpcAddr].Error()
+	}
+	return fmt.Sprintf("rpc xclient: all %d servers failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// cloneReply returns a new zero value of the same type as reply,
+// nil means the caller doesn't care about the reply.
+func cloneReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
@@ -0,0 +1,184 @@
+package xclient
+
+import (
+	"context"
+	. "geerpc"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthCheckOption configures the active health checking of XClient.
+type HealthCheckOption struct {
+	Interval           time.Duration // time between two probes of a server
+	Timeout            time.Duration // timeout of a single probe
+	UnhealthyThreshold int           // consecutive failed probes to remove a server from selection
+	HealthyThreshold   int           // consecutive successful probes to bring it back
+	Service            string        // service name passed to Health.Check, empty means the whole server
+}
+
+var DefaultHealthCheckOption = &HealthCheckOption{
+	Interval:           time.Second * 10,
+	Timeout:            time.Second,
+	UnhealthyThreshold: 3,
+	HealthyThreshold:   2,
+}
+
+type healthState struct {
+	healthy   bool
+	successes int // consecutive successful probes
+	failures  int // consecutive failed probes
+}
+
+// healthChecker probes every server of discovery with Health.Check
+// and keeps track of the unhealthy ones.
+type healthChecker struct {
+	opt    HealthCheckOption
+	mu     sync.Mutex // protect following
+	states map[string]*healthState
+	done   chan struct{}
+}
+
+func newHealthChecker(opt *HealthCheckOption) *healthChecker {
+	if opt == nil {
+		opt = DefaultHealthCheckOption
+	}
+	h := &healthChecker{
+		opt:    *opt,
+		states: make(map[string]*healthState),
+		done:   make(chan struct{}),
+	}
+	if h.opt.Interval <= 0 {
+		h.opt.Interval = DefaultHealthCheckOption.Interval
+	}
+	if h.opt.Timeout <= 0 {
+		h.opt.Timeout = DefaultHealthCheckOption.Timeout
+	}
+	if h.opt.UnhealthyThreshold <= 0 {
+		h.opt.UnhealthyThreshold = DefaultHealthCheckOption.UnhealthyThreshold
+	}
+	if h.opt.HealthyThreshold <= 0 {
+		h.opt.HealthyThreshold = DefaultHealthCheckOption.HealthyThreshold
+	}
+	return h
+}
+
+// filter removes unhealthy servers, a nil checker keeps all of them.
+func (h *healthChecker) filter(servers []string) []string {
+	if h == nil {
+		return servers
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	healthy := make([]string, 0, len(servers))
+	for _, rpcAddr := range servers {
+		if s := h.states[rpcAddr]; s == nil || s.healthy {
+			healthy = append(healthy, rpcAddr)
+		}
+	}
+	return healthy
+}
+
+// report records the result of a probe, and returns true if the health of rpcAddr changed.
+func (h *healthChecker) report(rpcAddr string, ok bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.states[rpcAddr]
+	if s == nil {
+		s = &healthState{healthy: true}
+		h.states[rpcAddr] = s
+	}
+	if ok {
+		s.successes++
+		s.failures = 0
+		if !s.healthy && s.successes >= h.opt.HealthyThreshold {
+			s.healthy = true
+			return true
+		}
+		return false
+	}
+	s.failures++
+	s.successes = 0
+	if s.healthy && s.failures >= h.opt.UnhealthyThreshold {
+		s.healthy = false
+		return true
+	}
+	return false
+}
+
+// forget drops the state of servers no longer in discovery.
+func (h *healthChecker) forget(servers []string) {
+	alive := make(map[string]bool, len(servers))
+	for _, rpcAddr := range servers {
+		alive[rpcAddr] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for rpcAddr := range h.states {
+		if !alive[rpcAddr] {
+			delete(h.states, rpcAddr)
+		}
+	}
+}
+
+func (h *healthChecker) stop() {
+	close(h.done)
+}
+
+// StartHealthCheck starts probing every server of discovery with Health.Check
+// on an interval, servers failing opt.UnhealthyThreshold probes in a row are
+// not selected until they pass opt.HealthyThreshold probes in a row.
+// Servers must register geerpc.Health. nil opt means DefaultHealthCheckOption.
+// The check stops when xc is closed.
+func (xc *XClient) StartHealthCheck(opt *HealthCheckOption) {
+	h := newHealthChecker(opt)
+	xc.mu.Lock()
+	if xc.health != nil {
+		xc.health.stop()
+	}
+	xc.health = h
+	xc.mu.Unlock()
+	go xc.runHealthCheck(h)
+}
+
+func (xc *XClient) runHealthCheck(h *healthChecker) {
+	t := time.NewTicker(h.opt.Interval)
+	defer t.Stop()
+	for {
+		xc.probeAll(h)
+		select {
+		case <-h.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (xc *XClient) probeAll(h *healthChecker) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		log.Println("rpc xclient: health check get servers error:", err)
+		return
+	}
+	h.forget(servers)
+	var wg sync.WaitGroup
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			ok := xc.probe(rpcAddr, h.opt)
+			if h.report(rpcAddr, ok) {
+				log.Printf("rpc xclient: server %s healthy: %t", rpcAddr, ok)
+			}
+		}(rpcAddr)
+	}
+	wg.Wait()
+}
+
+func (xc *XClient) probe(rpcAddr string, opt HealthCheckOption) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), opt.Timeout)
+	defer cancel()
+	var reply HealthCheckReply
+	err := xc.callRaw(rpcAddr, ctx, "Health.Check", HealthCheckArgs{Service: opt.Service}, &reply)
+	return err == nil && reply.Status == Serving
+}
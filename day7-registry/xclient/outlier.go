@@ -0,0 +1,224 @@
+package xclient
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// OutlierDetectionOption configures the passive outlier detection of XClient.
+type OutlierDetectionOption struct {
+	Interval         time.Duration // time between two evaluations, stats are reset after each one
+	BaseEjectionTime time.Duration // ejection time, multiplied by the number of times a server was ejected
+	ErrorRate        float64       // servers failing more than this rate of calls are ejected
+	LatencyFactor    float64       // servers slower than this factor of the median latency are ejected
+	MinRequests      int           // servers with fewer calls in an interval are not evaluated
+	// MaxEjectionPercent is the max percent of servers ejected at the same time,
+	// nil means 50, 0 turns ejection off.
+	MaxEjectionPercent *int
+}
+
+const defaultMaxEjectionPercent = 50
+
+var DefaultOutlierDetectionOption = &OutlierDetectionOption{
+	Interval:         time.Second * 10,
+	BaseEjectionTime: time.Second * 30,
+	ErrorRate:        0.5,
+	LatencyFactor:    5,
+	MinRequests:      5,
+}
+
+// serverStats are the outlier stats of a server, kept in XClient.clients.
+type serverStats struct {
+	requests int
+	errors   int
+	latency  time.Duration // total latency of successful calls
+
+	ejections    int       // times the server has been ejected, decays while it behaves
+	ejectedUntil time.Time // zero if not ejected
+}
+
+// record records the result of a call.
+func (s *serverStats) record(latency time.Duration, err error) {
+	s.requests++
+	if err != nil {
+		s.errors++
+	} else {
+		s.latency += latency
+	}
+}
+
+func (s *serverStats) meanLatency() time.Duration {
+	if succeeded := s.requests - s.errors; succeeded > 0 {
+		return s.latency / time.Duration(succeeded)
+	}
+	return 0
+}
+
+// outlierDetector evaluates the success rate and latency of real traffic
+// per server, and temporarily ejects the outliers from selection.
+// The stats are the ones of the states of XClient, protected by XClient.mu.
+type outlierDetector struct {
+	opt                OutlierDetectionOption
+	maxEjectionPercent int
+	done               chan struct{}
+}
+
+func newOutlierDetector(opt *OutlierDetectionOption) *outlierDetector {
+	if opt == nil {
+		opt = DefaultOutlierDetectionOption
+	}
+	o := &outlierDetector{
+		opt:                *opt,
+		maxEjectionPercent: defaultMaxEjectionPercent,
+		done:               make(chan struct{}),
+	}
+	if opt.MaxEjectionPercent != nil {
+		o.maxEjectionPercent = *opt.MaxEjectionPercent
+	}
+	if o.opt.Interval <= 0 {
+		o.opt.Interval = DefaultOutlierDetectionOption.Interval
+	}
+	if o.opt.BaseEjectionTime <= 0 {
+		o.opt.BaseEjectionTime = DefaultOutlierDetectionOption.BaseEjectionTime
+	}
+	if o.opt.ErrorRate <= 0 {
+		o.opt.ErrorRate = DefaultOutlierDetectionOption.ErrorRate
+	}
+	if o.opt.LatencyFactor <= 0 {
+		o.opt.LatencyFactor = DefaultOutlierDetectionOption.LatencyFactor
+	}
+	return o
+}
+
+// filter removes the servers ejected at now, a nil detector keeps all of them.
+func (o *outlierDetector) filter(states map[string]*serverState, servers []string, now time.Time) []string {
+	if o == nil {
+		return servers
+	}
+	selectable := make([]string, 0, len(servers))
+	for _, rpcAddr := range servers {
+		if st := states[rpcAddr]; st == nil || !st.stats.ejectedUntil.After(now) {
+			selectable = append(selectable, rpcAddr)
+		}
+	}
+	return selectable
+}
+
+// evaluate ejects the outliers among servers based on the stats
+// collected since the last evaluation, then resets the stats.
+func (o *outlierDetector) evaluate(states map[string]*serverState, servers []string, now time.Time) {
+	ejected, maxEjected := 0, len(servers)*o.maxEjectionPercent/100
+	var candidates []string
+	var latencies []time.Duration
+	for _, rpcAddr := range servers {
+		st := states[rpcAddr]
+		if st == nil {
+			continue
+		}
+		s := &st.stats
+		if s.ejectedUntil.After(now) {
+			ejected++
+			continue
+		}
+		if s.requests < o.opt.MinRequests || s.requests == 0 {
+			continue
+		}
+		candidates = append(candidates, rpcAddr)
+		if l := s.meanLatency(); l > 0 {
+			latencies = append(latencies, l)
+		}
+	}
+	median := medianLatency(latencies)
+
+	for _, rpcAddr := range candidates {
+		s := &states[rpcAddr].stats
+		errRate := float64(s.errors) / float64(s.requests)
+		slow := median > 0 && float64(s.meanLatency()) > o.opt.LatencyFactor*float64(median)
+		if errRate <= o.opt.ErrorRate && !slow {
+			if s.ejections > 0 {
+				s.ejections--
+			}
+			continue
+		}
+		if ejected >= maxEjected {
+			log.Printf("rpc xclient: outlier %s is not ejected, max ejection percent reached", rpcAddr)
+			continue
+		}
+		ejected++
+		s.ejections++
+		s.ejectedUntil = now.Add(o.opt.BaseEjectionTime * time.Duration(s.ejections))
+		log.Printf("rpc xclient: eject outlier %s until %s, error rate %.2f, latency %s (median %s)",
+			rpcAddr, s.ejectedUntil.Format(time.RFC3339), errRate, s.meanLatency(), median)
+	}
+
+	// reset stats for the next interval, and forget the stats of servers no
+	// longer in discovery, their clients are kept for the calls still running
+	alive := make(map[string]bool, len(servers))
+	for _, rpcAddr := range servers {
+		alive[rpcAddr] = true
+	}
+	for rpcAddr, st := range states {
+		switch {
+		case alive[rpcAddr]:
+			st.stats.requests, st.stats.errors, st.stats.latency = 0, 0, 0
+		case st.client == nil:
+			delete(states, rpcAddr)
+		default:
+			st.stats = serverStats{}
+		}
+	}
+}
+
+func medianLatency(latencies []time.Duration) time.Duration {
+	n := len(latencies)
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if n%2 == 0 {
+		return (latencies[n/2-1] + latencies[n/2]) / 2
+	}
+	return latencies[n/2]
+}
+
+func (o *outlierDetector) stop() {
+	close(o.done)
+}
+
+// StartOutlierDetection starts tracking the success rate and latency of every
+// server from the calls of xc, and ejects the outliers from selection for a
+// while, see OutlierDetectionOption. nil opt means DefaultOutlierDetectionOption.
+// The detection stops when xc is closed.
+func (xc *XClient) StartOutlierDetection(opt *OutlierDetectionOption) {
+	o := newOutlierDetector(opt)
+	xc.mu.Lock()
+	if xc.outliers != nil {
+		xc.outliers.stop()
+	}
+	xc.outliers = o
+	xc.mu.Unlock()
+	go xc.runOutlierDetection(o)
+}
+
+func (xc *XClient) runOutlierDetection(o *outlierDetector) {
+	t := time.NewTicker(o.opt.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case now := <-t.C:
+			servers, err := xc.d.GetAll()
+			if err != nil {
+				log.Println("rpc xclient: outlier detection get servers error:", err)
+				continue
+			}
+			xc.mu.Lock()
+			if xc.outliers == o {
+				o.evaluate(xc.clients, servers, now)
+			}
+			xc.mu.Unlock()
+		}
+	}
+}
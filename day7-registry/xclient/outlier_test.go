@@ -0,0 +1,139 @@
+package xclient
+
+import (
+	"errors"
+	"geerpc"
+	"testing"
+	"time"
+)
+
+func percent(p int) *int { return &p }
+
+// recordTraffic records 10 calls to every server, failed ones fail all of them.
+func recordTraffic(states map[string]*serverState, servers []string, latency time.Duration, failed ...string) {
+	for _, rpcAddr := range servers {
+		var err error
+		for _, f := range failed {
+			if f == rpcAddr {
+				err = errors.New("failed")
+			}
+		}
+		for i := 0; i < 10; i++ {
+			stateOf(states, rpcAddr).stats.record(latency, err)
+		}
+	}
+}
+
+func TestOutlierDetector_evaluate(t *testing.T) {
+	servers := makeServers(4)
+	states := make(map[string]*serverState)
+	o := newOutlierDetector(&OutlierDetectionOption{
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionPercent: percent(25),
+		MinRequests:        5,
+	})
+	// servers[2] fails all calls, servers[3] is 10x slower than the median
+	traffic := func() {
+		recordTraffic(states, servers[:3], time.Millisecond, servers[2])
+		recordTraffic(states, servers[3:], time.Millisecond*10)
+	}
+	now := time.Now()
+
+	traffic()
+	o.evaluate(states, servers, now)
+	got := o.filter(states, servers, now)
+	_assert(len(got) == 3 && got[2] == servers[3], "expect only servers[2] to be ejected, got %v", got)
+	s := &states[servers[2]].stats
+	_assert(s.ejections == 1 && s.ejectedUntil.Equal(now.Add(time.Minute)), "expect to eject for a minute")
+
+	// once its ejection ends, servers[2] is ejected again for longer,
+	// servers[3] is still kept by the max ejection percent
+	now = now.Add(time.Minute)
+	traffic()
+	o.evaluate(states, servers, now)
+	_assert(s.ejections == 2 && s.ejectedUntil.Equal(now.Add(time.Minute*2)), "expect to eject for 2 minutes")
+	_assert(states[servers[3]].stats.ejectedUntil.IsZero(), "expect servers[3] not to be ejected")
+
+	// servers no longer in discovery are forgotten, unless they have a client
+	states[servers[3]].client = new(geerpc.Client)
+	o.evaluate(states, servers[:2], now)
+	_assert(len(states) == 3 && states[servers[3]].stats == serverStats{}, "expect stats of removed servers to be dropped")
+}
+
+func TestOutlierDetector_maxEjectionPercent(t *testing.T) {
+	servers := makeServers(1)
+	states := make(map[string]*serverState)
+	o := newOutlierDetector(&OutlierDetectionOption{MinRequests: 1})
+	recordTraffic(states, servers, time.Millisecond, servers[0])
+	o.evaluate(states, servers, time.Now())
+	_assert(len(o.filter(states, servers, time.Now())) == 1, "expect not to eject the whole fleet")
+
+	// 3 of 4 servers fail
+	servers = makeServers(4)
+	for _, c := range []struct {
+		percent *int
+		ejected int
+	}{
+		{nil, 2}, // 50% by default
+		{percent(0), 0},
+		{percent(25), 1},
+		{percent(100), 3},
+	} {
+		states = make(map[string]*serverState)
+		o = newOutlierDetector(&OutlierDetectionOption{MinRequests: 1, MaxEjectionPercent: c.percent})
+		recordTraffic(states, servers, time.Millisecond, servers[1:]...)
+		now := time.Now()
+		o.evaluate(states, servers, now)
+		got := o.filter(states, servers, now)
+		_assert(len(got) == len(servers)-c.ejected, "expect %d servers ejected, got %v", c.ejected, got)
+		_assert(got[0] == servers[0], "expect the healthy server not to be ejected, got %v", got)
+	}
+}
+
+func TestOutlierDetector_unejection(t *testing.T) {
+	servers := makeServers(4)
+	states := make(map[string]*serverState)
+	o := newOutlierDetector(&OutlierDetectionOption{BaseEjectionTime: time.Minute, MinRequests: 1})
+	now := time.Now()
+	recordTraffic(states, servers, time.Millisecond, servers[0])
+	o.evaluate(states, servers, now)
+	s := &states[servers[0]].stats
+	_assert(s.ejections == 1, "expect servers[0] to be ejected")
+
+	// an ejected server is not evaluated again until its ejection ends
+	now = now.Add(time.Second * 30)
+	recordTraffic(states, servers, time.Millisecond, servers[0])
+	o.evaluate(states, servers, now)
+	_assert(len(o.filter(states, servers, now)) == 3 && s.ejections == 1, "expect servers[0] to stay ejected once")
+
+	// it's selectable again once the ejection ends, and the ejections decay
+	// while it behaves, so that a later ejection is short again
+	now = now.Add(time.Second * 30)
+	_assert(len(o.filter(states, servers, now)) == 4, "expect servers[0] to be selectable again")
+	recordTraffic(states, servers, time.Millisecond)
+	o.evaluate(states, servers, now)
+	_assert(s.ejections == 0 && len(o.filter(states, servers, now)) == 4, "expect the ejections to decay, got %d", s.ejections)
+	now = now.Add(time.Minute)
+	recordTraffic(states, servers, time.Millisecond, servers[0])
+	o.evaluate(states, servers, now)
+	_assert(s.ejections == 1 && s.ejectedUntil.Equal(now.Add(time.Minute)), "expect to eject for the base time again")
+}
+
+func TestXClient_serversFallback(t *testing.T) {
+	servers := makeServers(2)
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.StartOutlierDetection(&OutlierDetectionOption{Interval: time.Hour})
+	eject := func(rpcAddr string) {
+		xc.mu.Lock()
+		defer xc.mu.Unlock()
+		xc.state(rpcAddr).stats.ejectedUntil = time.Now().Add(time.Hour)
+	}
+
+	eject(servers[0])
+	got, _ := xc.servers("Foo.Sum")
+	_assert(len(got) == 1 && got[0] == servers[1], "expect servers[0] to be ejected, got %v", got)
+	eject(servers[1])
+	got, _ = xc.servers("Foo.Sum")
+	_assert(len(got) == 2, "expect all servers rather than none, got %v", got)
+}
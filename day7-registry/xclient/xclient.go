@@ -5,67 +5,177 @@ import (
 	. "geerpc"
 	"io"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
 //接下来，我们向用户暴露一个支持负载均衡的客户端 XClient。
 
 type XClient struct {
-	d       Discovery          //服务发现实例
-	mode    SelectMode         //调度模式的选择，负载均衡模式
-	opt     *Option            //协议选项
-	mu      sync.Mutex         // protect following
-	clients map[string]*Client //客服端请求实例序列
+	d        Discovery               //服务发现实例
+	b        Balancer                //负载均衡策略，从 d 提供的服务列表中选择一个服务实例
+	opt      *Option                 //协议选项
+	mu       sync.Mutex              // protect following
+	clients  map[string]*serverState //客服端请求实例序列, with the outlier stats of each server
+	health   *healthChecker          // nil unless StartHealthCheck is called
+	outliers *outlierDetector        // nil unless StartOutlierDetection is called
+	closed   bool                    // no client is dialed once closed, eg. by a probe still running
 }
 
 var _ io.Closer = (*XClient)(nil)
 
+// serverState is what XClient keeps for a server address.
+type serverState struct {
+	client *Client     // nil until dialed, or once it's no longer available
+	stats  serverStats // see StartOutlierDetection
+}
+
+// state returns the state of rpcAddr, created if needed. xc.mu must be held.
+func (xc *XClient) state(rpcAddr string) *serverState {
+	return stateOf(xc.clients, rpcAddr)
+}
+
+func stateOf(states map[string]*serverState, rpcAddr string) *serverState {
+	st := states[rpcAddr]
+	if st == nil {
+		st = new(serverState)
+		states[rpcAddr] = st
+	}
+	return st
+}
+
+// NewXClient creates a XClient using the built-in Balancer of mode.
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+	b, err := NewBalancer(mode)
+	if err != nil {
+		b = errBalancer{err}
+	}
+	return NewXClientWithBalancer(d, b, opt)
+}
+
+// NewXClientWithBalancer creates a XClient using a custom Balancer.
+func NewXClientWithBalancer(d Discovery, b Balancer, opt *Option) *XClient {
+	return &XClient{d: d, b: b, opt: opt, clients: make(map[string]*serverState)}
 }
 
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		// I have no idea how to deal with error, just ignore it.
-		_ = client.Close()
+	xc.closed = true
+	if xc.health != nil {
+		xc.health.stop()
+		xc.health = nil
+	}
+	if xc.outliers != nil {
+		xc.outliers.stop()
+		xc.outliers = nil
+	}
+	for key, st := range xc.clients {
+		if st.client != nil {
+			// I have no idea how to deal with error, just ignore it.
+			_ = st.client.Close()
+		}
 		delete(xc.clients, key)
 	}
 	return nil
 } //为了尽量地复用已经创建好的 Socket 连接，使用 clients
 // 保存创建成功的 Client 实例，并提供 Close 方法在结束后，关闭已经建立的连接
 //接下来，实现客户端最基本的功能 Call。
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+// dial returns the cached client of rpcAddr, or dials a new one. The dial is
+// done without holding xc.mu, so that a server slow to connect doesn't block
+// the calls to the others, and within the deadline of ctx.
+func (xc *XClient) dial(ctx context.Context, rpcAddr string) (*Client, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	client, ok := xc.clients[rpcAddr] //(xc利用原有的clients连接)
-	if ok && !client.IsAvailable() {  //检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态
+	if xc.closed {
+		xc.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	if st := xc.clients[rpcAddr]; st != nil && st.client != nil { //(xc利用原有的clients连接)
+		client := st.client
+		if client.IsAvailable() { //检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态
+			xc.mu.Unlock()
+			return client, nil
+		}
 		_ = client.Close() //如果是则返回缓存的 Client，如果不可用，则从缓存中删除
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt) //如果步骤 1) 没有返回缓存的 Client
-		if err != nil {                      //则说明需要创建新的 Client，缓存并返回。
-			return nil, err
+		st.client = nil
+	}
+	xc.mu.Unlock()
+
+	opt, err := xc.dialOption(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := XDial(rpcAddr, opt) //如果步骤 1) 没有返回缓存的 Client
+	if err != nil {                    //则说明需要创建新的 Client，缓存并返回。
+		return nil, err
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.closed {
+		_ = client.Close()
+		return nil, ErrShutdown
+	}
+	st := xc.state(rpcAddr)
+	if st.client != nil {
+		if st.client.IsAvailable() {
+			_ = client.Close() // dialed concurrently, keep the first one
+			return st.client, nil
 		}
-		xc.clients[rpcAddr] = client
+		_ = st.client.Close()
 	}
+	st.client = client
 	return client, nil
-	//检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态，
-	//如果是则返回缓存的 Client，如果不可用，则从缓存中删除。
-	//如果步骤 1) 没有返回缓存的 Client
-	//，则说明需要创建新的 Client，缓存并返回。
 }
+
+// dialOption returns the option of the clients, with a connect timeout
+// no longer than the time left before the deadline of ctx.
+func (xc *XClient) dialOption(ctx context.Context) (*Option, error) {
+	opt := *DefaultOption
+	if xc.opt != nil {
+		opt = *xc.opt
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		if opt.ConnectTimeout == 0 || left < opt.ConnectTimeout {
+			opt.ConnectTimeout = left
+		}
+	}
+	return &opt, nil
+}
+
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
+	start := time.Now()
+	err := xc.callRaw(rpcAddr, ctx, serviceMethod, args, reply)
+	// calls canceled by the caller say nothing about the server
+	if ctx.Err() != context.Canceled {
+		xc.mu.Lock()
+		if xc.outliers != nil {
+			xc.state(rpcAddr).stats.record(time.Since(start), err)
+		}
+		xc.mu.Unlock()
+	}
+	return err
+}
+
+// metrics returns the ClientMetrics of the clients of xc, the fan-out of Fork is recorded there too.
+func (xc *XClient) metrics() *ClientMetrics {
+	if xc.opt != nil && xc.opt.Metrics != nil {
+		return xc.opt.Metrics
+	}
+	return DefaultClientMetrics
+}
+
+// callRaw calls rpcAddr without recording stats for outlier detection.
+func (xc *XClient) callRaw(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	client, err := xc.dial(ctx, rpcAddr)
 	if err != nil {
 		return err
 	}
 	return client.Call(ctx, serviceMethod, args, reply)
-
 }
 
 //invokes 调用 call
@@ -73,51 +183,69 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 // and returns its error status.
 // xc will choose a proper server.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode) //根据负载均衡策略，选择一个服务实例
+	rpcAddr, err := xc.selectServer(ctx, serviceMethod, args) //根据负载均衡策略，选择一个服务实例
 	if err != nil {
 		return err
 	}
 	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
+// selectServer lets the balancer pick one of the servers provided by discovery,
+// the hash key of args is made available to the balancer through ctx.
+func (xc *XClient) selectServer(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+	servers, err := xc.servers(serviceMethod)
+	if err != nil {
+		return "", err
+	}
+	return xc.b.Pick(withArgsHashKey(ctx, args), servers)
+}
+
+// servers returns the servers of discovery that can be selected for serviceMethod,
+// servers not serving the service, unhealthy and ejected servers are left out,
+// unless none would be left, then unhealthy and ejected servers are kept.
+func (xc *XClient) servers(serviceMethod string) ([]string, error) {
+	var servers []string
+	var err error
+	if sd, ok := xc.d.(ServiceDiscovery); ok && strings.Contains(serviceMethod, ".") {
+		servers, err = sd.GetService(serviceMethod[:strings.LastIndex(serviceMethod, ".")])
+	} else {
+		servers, err = xc.d.GetAll()
+	}
+	if err != nil {
+		return nil, err
+	}
+	xc.mu.Lock()
+	h := xc.health
+	xc.mu.Unlock()
+	selectable := h.filter(servers)
+	xc.mu.Lock()
+	selectable = xc.outliers.filter(xc.clients, selectable, time.Now())
+	xc.mu.Unlock()
+	if len(selectable) == 0 {
+		return servers, nil // better than failing every call
+	}
+	return selectable, nil
+}
+
 //我们将复用 Client 的能力封装在方法 dial 中，dial 的处理逻辑如下：
 //检查 xc.clients 是否有缓存的 Client，如果有，检查是否是可用状态，
 //如果是则返回缓存的 Client，如果不可用，则从缓存中删除。
 //如果步骤 1) 没有返回缓存的 Client
 //，则说明需要创建新的 Client，缓存并返回。
 //另外，我们为 XClient 添加一个常用功能：Broadcast。
+// Broadcast invokes the named function on every server, it fails as soon as
+// any server fails. If all succeed, reply is set to one of the replies,
+// use Gather to get the reply of every server.
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	results, err := xc.Gather(ctx, serviceMethod, args, reply, GatherAll, 0)
 	if err != nil {
 		return err
 	}
-	var wg sync.WaitGroup //为了goroutine而设立的
-	var mu sync.Mutex     //同步锁，为了数据访问而设立的,protect e and replyDone
-	var e error
-	replyDone := reply == nil // if reply is nil, don't need to set value
-	ctx, cancel := context.WithCancel(ctx)
-	for _, rpcAddr := range servers {
-		wg.Add(1)
-		go func(rpcAddr string) {
-			defer wg.Done()
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
-			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
-			mu.Lock()
-			if err != nil && e == nil {
-				e = err
-				cancel() // if any call failed, cancel unfinished calls
-			}
-			if err != nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
-				replyDone = true
-			}
-			mu.Unlock()
-		}(rpcAddr)
-		// WithCancel()函数接受一个 Context 并返回其子Context和取消函数cancel
-	}
-	wg.Wait() //等待WaitGroup 归0子线程全部结束，父线程才结束
-	return e
+	if reply != nil {
+		for _, r := range results {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.Reply).Elem())
+			break
+		}
+	}
+	return nil
 }
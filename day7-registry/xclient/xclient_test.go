@@ -0,0 +1,433 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geerpc"
+	"geerpc/registry"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Args struct{ Num1, Num2 int }
+
+// Foo is served by every test server, it fails all calls if Broken is set.
+type Foo struct {
+	Broken bool
+	Delay  time.Duration
+}
+
+func (f *Foo) Sum(args Args, reply *int) error {
+	time.Sleep(f.Delay)
+	if f.Broken {
+		return errors.New("foo is broken")
+	}
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// startServer starts a geerpc server serving foo and the given extra services,
+// and returns its rpcAddr.
+func startServer(t *testing.T, foo *Foo, services ...interface{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	server := geerpc.NewServer()
+	_ = server.Register(foo)
+	for _, svc := range services {
+		_ = server.Register(svc)
+	}
+	go server.Accept(l)
+	t.Cleanup(func() { _ = l.Close() })
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_Gather(t *testing.T) {
+	ok1 := startServer(t, &Foo{})
+	ok2 := startServer(t, &Foo{})
+	slow := startServer(t, &Foo{Delay: time.Second * 2})
+	broken := startServer(t, &Foo{Broken: true})
+	args := &Args{Num1: 1, Num2: 2}
+
+	t.Run("all", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok1, ok2}), RandomSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherAll, 0)
+		_assert(err == nil && len(results) == 2, "expect 2 results, got %d: %v", len(results), err)
+		for addr, r := range results {
+			_assert(r.Error == nil && *r.Reply.(*int) == 3, "wrong result of %s", addr)
+		}
+		_assert(reply == 0, "reply is only a prototype")
+
+		err = xc.Broadcast(context.Background(), "Foo.Sum", args, &reply)
+		_assert(err == nil && reply == 3, "expect broadcast reply 3, got %d: %v", reply, err)
+	})
+	t.Run("all fail fast", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok1, slow, broken}), RandomSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		start := time.Now()
+		results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherAll, 0)
+		_assert(err != nil && time.Since(start) < time.Second, "expect to fail fast, got %v", err)
+		_assert(results[broken].Error != nil && results[slow].Error != nil, "expect errors of broken and slow")
+	})
+	t.Run("first n", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok1, ok2, slow, broken}), RandomSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		start := time.Now()
+		results, err := xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherFirstN, 2)
+		_assert(err == nil && time.Since(start) < time.Second, "expect 2 quick successes, got %v", err)
+		_assert(results[ok1].Error == nil && results[ok2].Error == nil, "expect ok1 and ok2 to succeed")
+		_assert(results[slow].Error != nil, "expect slow to be canceled")
+
+		_, err = xc.Gather(context.Background(), "Foo.Sum", args, &reply, GatherFirstN, 5)
+		_assert(err != nil, "expect an error when n is more than servers")
+	})
+	t.Run("best effort", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok1, slow, broken}), RandomSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		results, err := xc.Gather(ctx, "Foo.Sum", args, &reply, GatherBestEffort, 0)
+		_assert(err == nil && len(results) == 3, "expect best effort to succeed, got %v", err)
+		_assert(results[ok1].Error == nil && *results[ok1].Reply.(*int) == 3, "expect ok1 to succeed")
+		_assert(results[slow].Error != nil && results[broken].Error != nil, "expect slow and broken to fail")
+	})
+}
+
+func TestXClient_Fork(t *testing.T) {
+	ok := startServer(t, &Foo{})
+	slow := startServer(t, &Foo{Delay: time.Second * 2})
+	broken1 := startServer(t, &Foo{Broken: true})
+	broken2 := startServer(t, &Foo{Broken: true})
+	args := &Args{Num1: 1, Num2: 2}
+
+	t.Run("first success", func(t *testing.T) {
+		metrics := geerpc.NewClientMetrics()
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok, slow, broken1}), RandomSelect, &geerpc.Option{Metrics: metrics})
+		defer func() { _ = xc.Close() }()
+		var reply int
+		start := time.Now()
+		err := xc.Fork(context.Background(), "Foo.Sum", args, &reply, 0)
+		_assert(err == nil && reply == 3, "expect reply 3, got %d: %v", reply, err)
+		_assert(time.Since(start) < time.Second, "expect not to wait for the slow server")
+		var b strings.Builder
+		_ = metrics.WriteMetrics(&b)
+		_assert(strings.Contains(b.String(), `geerpc_client_fanout_requests_total{service="Foo",method="Sum"} 2`+"\n"), "expect a fan-out of 2:\n%s", b.String())
+		_assert(strings.Contains(b.String(), `geerpc_client_requests_total{target="`+ok+`",service="Foo",method="Sum"} 1`+"\n"), "expect calls by target:\n%s", b.String())
+	})
+	t.Run("all failed", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{ok, broken1, broken2}), RoundRobinSelect, nil)
+		defer func() { _ = xc.Close() }()
+		servers, _ := xc.selectServers(context.Background(), "Foo.Sum", args, 2)
+		_assert(len(servers) == 2 && servers[0] != servers[1], "expect 2 distinct servers, got %v", servers)
+
+		xc2 := NewXClient(NewMultiServerDiscovery([]string{broken1, broken2}), RandomSelect, nil)
+		defer func() { _ = xc2.Close() }()
+		var reply int
+		err := xc2.Fork(context.Background(), "Foo.Sum", args, &reply, 2)
+		errs, isServerErrors := err.(ServerErrors)
+		_assert(isServerErrors && len(errs) == 2, "expect errors of 2 servers, got %v", err)
+		_assert(errs[broken1] != nil && errs[broken2] != nil, "expect errors of broken servers")
+	})
+}
+
+func TestXClient_StartHealthCheck(t *testing.T) {
+	health := geerpc.NewHealth()
+	wedged := startServer(t, &Foo{}, health)
+	ok := startServer(t, &Foo{}, geerpc.NewHealth())
+	xc := NewXClient(NewMultiServerDiscovery([]string{wedged, ok}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.StartHealthCheck(&HealthCheckOption{
+		Interval:           time.Millisecond * 20,
+		UnhealthyThreshold: 2,
+		HealthyThreshold:   2,
+	})
+	waitServers := func(want int) []string {
+		var servers []string
+		for i := 0; i < 50; i++ {
+			servers, _ = xc.servers("Foo.Sum")
+			if len(servers) == want {
+				break
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		return servers
+	}
+
+	health.SetServingStatus("", false)
+	servers := waitServers(1)
+	_assert(len(servers) == 1 && servers[0] == ok, "expect wedged server to be removed, got %v", servers)
+	var reply int
+	err := xc.Fork(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, 0)
+	_assert(err == nil && reply == 3, "expect the healthy server to be called: %v", err)
+
+	health.SetServingStatus("", true)
+	servers = waitServers(2)
+	_assert(len(servers) == 2, "expect wedged server to recover, got %v", servers)
+
+	// probes still running once closed don't dial new clients
+	_ = xc.Close()
+	ok1 := xc.probe(ok, *DefaultHealthCheckOption)
+	xc.mu.Lock()
+	n := len(xc.clients)
+	xc.mu.Unlock()
+	_assert(!ok1 && n == 0, "expect no client to be dialed once closed, got %d", n)
+}
+
+func TestXClient_dial(t *testing.T) {
+	// accepts connections but never answers the http CONNECT of the client
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	hanging := "http@" + l.Addr().String()
+	ok := startServer(t, &Foo{}, geerpc.NewHealth())
+	xc := NewXClient(NewMultiServerDiscovery([]string{hanging, ok}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// a probe dials within its timeout, not the connect timeout of 10s
+	start := time.Now()
+	_assert(!xc.probe(hanging, HealthCheckOption{Timeout: time.Millisecond * 100}), "expect the hanging server to fail")
+	_assert(time.Since(start) < time.Second, "expect the dial to be bounded by the probe timeout, took %s", time.Since(start))
+
+	// calls to the other servers don't wait for the dial
+	go xc.probe(hanging, HealthCheckOption{Timeout: time.Second * 2})
+	time.Sleep(time.Millisecond * 50)
+	start = time.Now()
+	var reply int
+	err := xc.call(ok, context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect the call to succeed: %v", err)
+	_assert(time.Since(start) < time.Second, "expect not to wait for the hanging dial, took %s", time.Since(start))
+}
+
+type Bar int
+
+func (b Bar) Echo(arg string, reply *string) error {
+	*reply = arg
+	return nil
+}
+
+func TestXClient_serviceDiscovery(t *testing.T) {
+	reg := httptest.NewServer(registry.New(time.Minute))
+	defer reg.Close()
+	fooAddr := startServer(t, &Foo{})
+	var bar Bar
+	barAddr := startServer(t, &Foo{}, &bar)
+	fooBeat := registry.HeartbeatItem(reg.URL, &registry.ServerItem{Addr: fooAddr, Services: []string{"Foo.Sum"}, Zone: "a"}, time.Minute)
+	defer func() { _ = fooBeat.Stop() }()
+	barBeat := registry.Heartbeat(reg.URL, barAddr, time.Minute, "Bar.Echo")
+	defer func() { _ = barBeat.Stop() }()
+
+	d := NewGeeRegistryDiscovery(reg.URL, 0)
+	all, _ := d.GetAll()
+	_assert(len(all) == 2, "expect 2 servers, got %v", all)
+	foos, _ := d.GetService("Foo")
+	_assert(len(foos) == 1 && foos[0] == fooAddr, "expect only the Foo server, got %v", foos)
+	item, ok := d.Instance(fooAddr)
+	_assert(ok && item.Zone == "a" && item.Services[0] == "Foo", "expect metadata of the Foo server, got %+v", item)
+
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 4; i++ {
+		servers, _ := xc.servers("Bar.Echo")
+		_assert(len(servers) == 1 && servers[0] == barAddr, "expect only the Bar server, got %v", servers)
+		var reply string
+		err := xc.Call(context.Background(), "Bar.Echo", "hi", &reply)
+		_assert(err == nil && reply == "hi", "expect Bar.Echo to succeed: %v", err)
+	}
+
+	// servers set by Update replace the cached servers of each service
+	_ = d.Update([]string{fooAddr})
+	servers, _ := xc.servers("Foo.Sum")
+	_assert(len(servers) == 1 && servers[0] == fooAddr, "expect the updated servers, got %v", servers)
+	servers, _ = xc.servers("Bar.Echo")
+	_assert(len(servers) == 0, "expect the Foo server to be known not to serve Bar, got %v", servers)
+
+	// a failed refresh keeps the servers and their metadata
+	d.lastUpdate = time.Time{}
+	reg.Close()
+	_assert(d.Refresh() != nil, "expect the refresh to fail")
+	item, ok = d.Instance(barAddr)
+	all, _ = d.MultiServersDiscovery.GetAll()
+	_assert(ok && item.Services[0] == "Bar" && len(all) == 1, "expect metadata to be kept, got %+v %v", item, all)
+}
+
+func TestGeeRegistryWatchDiscovery(t *testing.T) {
+	reg := httptest.NewServer(registry.New(time.Minute))
+	defer reg.Close()
+	d := NewGeeRegistryWatchDiscovery(reg.URL, time.Second*5)
+	defer func() { _ = d.Close() }()
+	all, err := d.GetAll()
+	_assert(err == nil && len(all) == 0, "expect no server, got %v %v", all, err)
+
+	waitFor := func(n int) []string {
+		start := time.Now()
+		for time.Since(start) < time.Second {
+			if all, _ = d.GetAll(); len(all) == n {
+				return all
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		panic(fmt.Sprintf("expect %d servers long before the watch wait, got %v", n, all))
+	}
+	foo := registry.HeartbeatItem(reg.URL, &registry.ServerItem{Addr: "tcp@foo:1", Services: []string{"Foo"}, Zone: "a"}, time.Minute)
+	waitFor(1)
+	bar := registry.Heartbeat(reg.URL, "tcp@bar:1", time.Minute, "Bar")
+	waitFor(2)
+	item, ok := d.Instance("tcp@foo:1")
+	_assert(ok && item.Zone == "a", "expect metadata of the Foo server, got %+v", item)
+	foos, _ := d.GetService("Foo")
+	_assert(len(foos) == 1 && foos[0] == "tcp@foo:1", "expect only the Foo server, got %v", foos)
+
+	_ = foo.Stop()
+	all = waitFor(1)
+	_assert(all[0] == "tcp@bar:1", "expect the Foo server to be removed, got %v", all)
+	_ = bar.Stop()
+	waitFor(0)
+}
+
+func TestGeeRegistryDiscovery_failover(t *testing.T) {
+	dead := httptest.NewServer(registry.New(time.Minute))
+	dead.Close()
+	reg := httptest.NewServer(registry.New(time.Minute))
+	defer reg.Close()
+	h := registry.Heartbeat(dead.URL+","+reg.URL, "tcp@foo:1", time.Minute)
+	defer func() { _ = h.Stop() }()
+
+	d := NewGeeRegistryDiscovery(dead.URL+","+reg.URL, 0)
+	all, err := d.GetAll()
+	_assert(err == nil && len(all) == 1 && all[0] == "tcp@foo:1", "expect to fail over, got %v %v", all, err)
+	wd := NewGeeRegistryWatchDiscovery(dead.URL+","+reg.URL, 0)
+	defer func() { _ = wd.Close() }()
+	all, err = wd.GetAll()
+	_assert(err == nil && len(all) == 1, "expect the watch to fail over, got %v %v", all, err)
+}
+
+func TestGeeRegistryDiscovery_hangingRegistry(t *testing.T) {
+	hang := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-hang }))
+	defer hanging.Close()
+	defer close(hang)
+	reg := httptest.NewServer(registry.New(time.Minute))
+	defer reg.Close()
+	h := registry.Heartbeat(reg.URL, "tcp@foo:1", time.Minute)
+	defer func() { _ = h.Stop() }()
+
+	d := NewGeeRegistryDiscovery(hanging.URL+","+reg.URL, 0)
+	d.client.Timeout = time.Millisecond * 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		all, err := d.GetAll()
+		_assert(err == nil && len(all) == 1, "expect to fail over from the hanging registry, got %v %v", all, err)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	d.Instance("tcp@foo:1")
+	_assert(time.Since(start) < time.Millisecond*100, "expect not to wait for the fetch")
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("expect the fetch to time out")
+	}
+}
+
+func TestGeeRegistryDiscovery_namespace(t *testing.T) {
+	r := registry.New(time.Minute)
+	r.SetToken("prod", "secret")
+	reg := httptest.NewServer(r)
+	defer reg.Close()
+	h := registry.Heartbeat(reg.URL, "tcp@staging:1", time.Minute)
+	defer func() { _ = h.Stop() }()
+	prod := registry.NewHeartbeater([]string{reg.URL}, &registry.ServerItem{Addr: "tcp@prod:1", Namespace: "prod"},
+		&registry.HeartbeatOption{Token: "secret"})
+	prod.Start(context.Background())
+	defer func() { _ = prod.Stop() }()
+
+	scope := registry.Scope{Namespace: "prod", Token: "secret"}
+	for _, d := range []Discovery{
+		NewGeeRegistryDiscovery(reg.URL, 0, scope),
+		NewGeeRegistryWatchDiscovery(reg.URL, 0, scope),
+	} {
+		all, err := d.GetAll()
+		_assert(err == nil && len(all) == 1 && all[0] == "tcp@prod:1", "expect the prod server only, got %v %v", all, err)
+		if wd, ok := d.(*GeeRegistryWatchDiscovery); ok {
+			_ = wd.Close()
+		}
+	}
+	_, err := NewGeeRegistryDiscovery(reg.URL, 0, registry.Scope{Namespace: "prod"}).GetAll()
+	_assert(err != nil && strings.Contains(err.Error(), "401"), "expect unauthorized without the token, got %v", err)
+	all, _ := NewGeeRegistryDiscovery(reg.URL, 0).GetAll()
+	_assert(len(all) == 1 && all[0] == "tcp@staging:1", "expect the default namespace, got %v", all)
+}
+
+func TestGeeRegistryRPCDiscovery(t *testing.T) {
+	// one process is both a geerpc server and a registry
+	r := registry.New(time.Minute)
+	defer func() { _ = r.Close() }()
+	rpcAddr := startServer(t, &Foo{}, registry.NewService(r))
+	d := NewGeeRegistryRPCDiscovery(rpcAddr, time.Second*5, nil)
+	defer func() { _ = d.Close() }()
+	all, err := d.GetAll()
+	_assert(err == nil && len(all) == 0, "expect no server, got %v %v", all, err)
+
+	client, err := geerpc.XDial(rpcAddr)
+	_assert(err == nil, "failed to dial registry: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply registry.RegisterReply
+	err = client.Call(context.Background(), "Registry.Register", registry.RegisterArgs{Item: registry.ServerItem{Addr: rpcAddr, Zone: "a"}}, &reply)
+	_assert(err == nil && reply.Created && reply.Item.Zone == "a", "expect to register: %v %+v", err, reply)
+	var ok bool
+	err = client.Call(context.Background(), "Registry.Renew", registry.RenewArgs{Addr: "tcp@bar:1", Services: []string{"Bar"}}, &ok)
+	_assert(err == nil && ok, "expect to renew: %v", err)
+	var list registry.ListReply
+	err = client.Call(context.Background(), "Registry.List", registry.ListArgs{Service: "Bar"}, &list)
+	_assert(err == nil && len(list.Servers) == 2 && list.Index == 2, "expect 2 servers, got %+v", list)
+	r.SetToken("prod", "secret")
+	err = client.Call(context.Background(), "Registry.List", registry.ListArgs{Namespace: "prod"}, &list)
+	_assert(err != nil && strings.Contains(err.Error(), "invalid token"), "expect the token to be checked, got %v", err)
+
+	waitFor := func(n int) {
+		start := time.Now()
+		for time.Since(start) < time.Second {
+			if all, _ = d.GetAll(); len(all) == n {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		panic(fmt.Sprintf("expect %d servers long before the watch wait, got %v", n, all))
+	}
+	waitFor(2)
+	item, _ := d.Instance(rpcAddr)
+	_assert(item.Zone == "a", "expect metadata, got %+v", item)
+
+	err = client.Call(context.Background(), "Registry.Deregister", registry.DeregisterArgs{Addr: "tcp@bar:1"}, &ok)
+	_assert(err == nil, "expect to deregister: %v", err)
+	waitFor(1)
+	err = client.Call(context.Background(), "Registry.Deregister", registry.DeregisterArgs{Addr: "tcp@bar:1"}, &ok)
+	_assert(err != nil && strings.Contains(err.Error(), "not found"), "expect not found, got %v", err)
+
+	// servers found through the registry are called as usual
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var sum int
+	err = xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "expect Foo.Sum to succeed: %v", err)
+}